@@ -0,0 +1,107 @@
+package rascaldb
+
+import "context"
+
+// Batch is a sequence of Set and Delete operations which are written to database atomically,
+// see DB.Write. The zero value is an empty batch ready to use. Batch is not concurrency safe.
+type Batch struct {
+	ops []batchOp
+}
+
+// batchOp is a batch operation: set a key or delete it.
+type batchOp struct {
+	key     string
+	value   []byte
+	deleted bool
+	// expires is an expiration time of the key in Unix nanoseconds, zero means the key doesn't expire.
+	expires int64
+}
+
+// Set adds a key-value pair to the batch. The value is copied, so it can be reused by the caller.
+func (b *Batch) Set(key string, value []byte) {
+	b.ops = append(b.ops, batchOp{
+		key:   key,
+		value: append([]byte{}, value...),
+	})
+}
+
+// Delete adds a deletion of the key to the batch.
+func (b *Batch) Delete(key string) {
+	b.ops = append(b.ops, batchOp{
+		key:     key,
+		deleted: true,
+	})
+}
+
+// Len returns a number of operations in the batch.
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// Reset clears the batch, so it can be reused.
+func (b *Batch) Reset() {
+	b.ops = b.ops[:0]
+}
+
+// encodedBatch is a batch encoded into records which are ready to be appended to a segment.
+// Writes are encoded before they are sent to the actor, so the actor doesn't access the batch
+// which the caller could reuse after it stopped waiting.
+type encodedBatch struct {
+	// records are the encoded records of the batch.
+	records []byte
+	// keys are the batch keys in the order of operations.
+	keys []string
+	// entries point to the records of the keys. Offsets are relative to the beginning of the encoded records.
+	entries []entry
+}
+
+// encode encodes batch records. Batch header is added only when there are several records,
+// because a single record is written atomically anyway.
+// ErrTooLarge is returned if any key-value pair doesn't fit into a record.
+func (b *Batch) encode() (encodedBatch, error) {
+	eb := encodedBatch{
+		keys:    make([]string, len(b.ops)),
+		entries: make([]entry, len(b.ops)),
+	}
+	if len(b.ops) > 1 {
+		eb.records = encodeBatchHeader(len(b.ops))
+	}
+	for i, op := range b.ops {
+		if err := checkRecordLen(op.key, op.value); err != nil {
+			return encodedBatch{}, err
+		}
+		var r []byte
+		if op.deleted {
+			r = encodeTombstone(op.key)
+		} else {
+			r = encodeExpiring(op.key, op.value, op.expires)
+		}
+		eb.keys[i] = op.key
+		eb.entries[i] = entry{
+			offset:  int64(len(eb.records)),
+			size:    uint32(len(r)),
+			deleted: op.deleted,
+			expires: op.expires,
+		}
+		eb.records = append(eb.records, r...)
+	}
+	return eb, nil
+}
+
+// Write applies the batch to database atomically: either all its operations are stored or none of them.
+// Records of the batch are appended to the current segment as one unit with a single fsync.
+// If db crashed while the batch was being written, the batch is discarded when db is opened.
+// You can call it concurrently.
+func (db *DB) Write(b *Batch) error {
+	return db.WriteContext(context.Background(), b)
+}
+
+// WriteContext is like Write, but it returns ctx.Err() when the context is done before the batch is written.
+// The batch is encoded before WriteContext starts waiting, so it can be reused once WriteContext returns
+// even if the batch is still being written.
+func (db *DB) WriteContext(ctx context.Context, b *Batch) error {
+	if b.Len() == 0 {
+		return nil
+	}
+	return db.write(ctx, b)
+}
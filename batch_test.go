@@ -0,0 +1,139 @@
+package rascaldb
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestDB_Write(t *testing.T) {
+	dbpath := "testdata/batch.db"
+	db, err := Open(dbpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Set("nick", []byte("B0B")); err != nil {
+		t.Fatal(err)
+	}
+
+	value := []byte("Bob")
+	b := Batch{}
+	b.Set("name", value)
+	b.Set("city", []byte("Ankh-Morpork"))
+	b.Delete("nick")
+	b.Set("name", []byte("Rob"))
+	// The batch has a copy of the value.
+	value[0] = 'J'
+	if b.Len() != 4 {
+		t.Errorf("Len() = %d, want 4", b.Len())
+	}
+	if err = db.Write(&b); err != nil {
+		t.Fatalf("Write() error %v", err)
+	}
+
+	check := func() {
+		t.Helper()
+		want := map[string]string{"name": "Rob", "city": "Ankh-Morpork"}
+		for k, v := range want {
+			got, err := db.Get(k)
+			if err != nil || !bytes.Equal(got, []byte(v)) {
+				t.Errorf("Get(%q) = %q, %v, want %q", k, got, err, v)
+			}
+		}
+		if _, err := db.Get("nick"); err != ErrKeyNotFound {
+			t.Errorf("Get(%q) error %v, want %v", "nick", err, ErrKeyNotFound)
+		}
+	}
+	check()
+	db.Close()
+
+	if db, err = Open(dbpath); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check()
+
+	b.Reset()
+	if err = db.Write(&b); err != nil || b.Len() != 0 {
+		t.Errorf("Write() empty batch error %v", err)
+	}
+
+	teardown()
+}
+
+func TestDB_Write_torn(t *testing.T) {
+	dbpath := "testdata/batch.db"
+	db, err := Open(dbpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Set("name", []byte("Bob")); err != nil {
+		t.Fatal(err)
+	}
+	segments := db.segments.Load().([]*segment)
+	current := segments[len(segments)-1]
+	batchStart := current.offset
+
+	b := Batch{}
+	b.Set("name", []byte("Rob"))
+	b.Set("nick", []byte("B0B"))
+	if err = db.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// Simulate a crash when the last record of the batch wasn't written.
+	if err = os.Truncate(current.name, current.offset-1); err != nil {
+		t.Fatal(err)
+	}
+
+	if db, err = Open(dbpath); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if got, err := db.Get("name"); err != nil || !bytes.Equal(got, []byte("Bob")) {
+		t.Errorf("Get(%q) = %q, %v, want %q", "name", got, err, "Bob")
+	}
+	if _, err = db.Get("nick"); err != ErrKeyNotFound {
+		t.Errorf("Get(%q) error %v, want %v", "nick", err, ErrKeyNotFound)
+	}
+
+	fi, err := os.Stat(current.name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != batchStart {
+		t.Errorf("Open() segment size %d, want %d", fi.Size(), batchStart)
+	}
+
+	teardown()
+}
+
+func TestDB_Write_tooLarge(t *testing.T) {
+	dbpath := "testdata/batch.db"
+	db, err := Open(dbpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardown()
+	defer db.Close()
+
+	// The value doesn't fit into a record by one byte. Its memory is never touched.
+	value := make([]byte, maxRecordLen-(recordHeaderSize+flagsSize+keyLenSize+expiresSize)-len("key")+1)
+	if err = db.Set("key", value); err != ErrTooLarge {
+		t.Errorf("Set() error %v, want %v", err, ErrTooLarge)
+	}
+	var b Batch
+	b.Set("a", []byte("1"))
+	b.ops = append(b.ops, batchOp{key: "key", value: value})
+	if err = db.Write(&b); err != ErrTooLarge {
+		t.Errorf("Write() error %v, want %v", err, ErrTooLarge)
+	}
+	if _, err = db.Get("a"); err != ErrKeyNotFound {
+		t.Errorf("Get(%q) error %v, want %v", "a", err, ErrKeyNotFound)
+	}
+	if err = checkRecordLen("key", value[1:]); err != nil {
+		t.Errorf("checkRecordLen() of max record error %v", err)
+	}
+}
@@ -0,0 +1,171 @@
+package rascaldb
+
+import (
+	"bytes"
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CacheStats is a number of cache hits and misses, see DB.CacheStats.
+type CacheStats struct {
+	// Hits is a number of Get calls which found a value in the cache.
+	Hits uint64
+	// Misses is a number of Get calls which read a value from disk.
+	Misses uint64
+	// Size is a total size of cached keys and values in bytes.
+	Size int64
+}
+
+// CacheStats returns statistics of the value cache.
+// It is zero if db was opened without Options.CacheSize.
+func (db *DB) CacheStats() CacheStats {
+	if db.cache == nil {
+		return CacheStats{}
+	}
+	return db.cache.stats()
+}
+
+// cache is a size-bounded LRU cache of values which saves disk reads of hot keys.
+// Every value is cached along with the location of its record,
+// so a value is returned only if the key still points to the same record.
+// That way a value read before a concurrent write never shadows the newer value.
+// Cache is safe for concurrent use.
+// A nil cache is valid: it never has values.
+type cache struct {
+	// maxSize is a max total size of cached keys and values in bytes.
+	maxSize int64
+
+	mu   sync.Mutex
+	size int64
+	// lru is a list of cached items, the most recently used item is in front.
+	lru   *list.List
+	items map[string]*list.Element
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+// cacheItem is a cached value of the key stored in the record e of the segment.
+// The segment is referenced by its id, so the cache doesn't keep segments replaced by compaction in memory.
+type cacheItem struct {
+	key     string
+	segment uint64
+	e       entry
+	value   []byte
+}
+
+// at reports whether the item was cached from the record at loc.
+func (item *cacheItem) at(loc location) bool {
+	return loc.s != nil && item.segment == loc.s.id && item.e == loc.e
+}
+
+// newCache returns a cache which holds up to maxSize bytes of keys and values.
+func newCache(maxSize int64) *cache {
+	return &cache{
+		maxSize: maxSize,
+		lru:     list.New(),
+		items:   make(map[string]*list.Element),
+	}
+}
+
+// get returns a copy of the cached value of the key if it was cached from the record at loc.
+// The record must exist, i.e., it is not a tombstone, otherwise there is nothing to read from disk
+// and it must not be counted as a miss.
+func (c *cache) get(key string, loc location) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	// An expired value is reported as a miss, so the caller finds out the key has expired.
+	if loc.e.expired(time.Now().UnixNano()) {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	el, ok := c.items[key]
+	if ok && el.Value.(*cacheItem).at(loc) {
+		c.lru.MoveToFront(el)
+		value := bytes.Clone(el.Value.(*cacheItem).value)
+		c.mu.Unlock()
+		c.hits.Add(1)
+		return value, true
+	}
+	c.mu.Unlock()
+	c.misses.Add(1)
+	return nil, false
+}
+
+// add caches a copy of the key's value read from the record at loc.
+// The least recently used values are evicted to fit the new one.
+func (c *cache) add(key string, loc location, value []byte) {
+	if c == nil {
+		return
+	}
+	size := itemSize(key, value)
+	if size > c.maxSize {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.removeElement(el)
+	}
+	for c.size+size > c.maxSize {
+		c.removeElement(c.lru.Back())
+	}
+	c.items[key] = c.lru.PushFront(&cacheItem{
+		key:     key,
+		segment: loc.s.id,
+		e:       loc.e,
+		value:   bytes.Clone(value),
+	})
+	c.size += size
+}
+
+// remove evicts the key from the cache, e.g., when the key is overwritten or deleted.
+func (c *cache) remove(key string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	if el, ok := c.items[key]; ok {
+		c.removeElement(el)
+	}
+	c.mu.Unlock()
+}
+
+// removeElement removes the cached item. Note, c.mu must be held.
+func (c *cache) removeElement(el *list.Element) {
+	item := c.lru.Remove(el).(*cacheItem)
+	delete(c.items, item.key)
+	c.size -= itemSize(item.key, item.value)
+}
+
+// stats returns cache statistics.
+func (c *cache) stats() CacheStats {
+	c.mu.Lock()
+	size := c.size
+	c.mu.Unlock()
+	return CacheStats{
+		Hits:   c.hits.Load(),
+		Misses: c.misses.Load(),
+		Size:   size,
+	}
+}
+
+// itemSize is a size of the cached key and value in bytes.
+func itemSize(key string, value []byte) int64 {
+	return int64(len(key) + len(value))
+}
+
+// invalidate evicts keys of the batches from the cache after they were written.
+// Note, it must be called only from the actor.
+func (db *DB) invalidate(batches ...encodedBatch) {
+	for _, b := range batches {
+		for _, key := range b.keys {
+			db.cache.remove(key)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package rascaldb
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCache_evict(t *testing.T) {
+	// Every item is 2 bytes: one byte key and one byte value.
+	c := newCache(4)
+	s := &segment{}
+	loc := func(offset int64) location {
+		return location{s: s, e: entry{offset: offset}}
+	}
+	c.add("a", loc(1), []byte("1"))
+	c.add("b", loc(2), []byte("2"))
+	// Key "a" becomes the most recently used.
+	if _, ok := c.get("a", loc(1)); !ok {
+		t.Errorf("get(%q) missed", "a")
+	}
+	c.add("c", loc(3), []byte("3"))
+
+	if _, ok := c.get("b", loc(2)); ok {
+		t.Errorf("get(%q) hit, want the least recently used key evicted", "b")
+	}
+	for key, offset := range map[string]int64{"a": 1, "c": 3} {
+		if _, ok := c.get(key, loc(offset)); !ok {
+			t.Errorf("get(%q) missed", key)
+		}
+	}
+	// The key points to another record, so the cached value is stale.
+	if _, ok := c.get("a", loc(4)); ok {
+		t.Errorf("get(%q) of another record hit", "a")
+	}
+	// The record at the same offset in another segment, e.g., written by compaction, is not cached.
+	if _, ok := c.get("a", location{s: &segment{id: s.id + 1}, e: entry{offset: 1}}); ok {
+		t.Errorf("get(%q) of another segment hit", "a")
+	}
+	// A value which doesn't fit into the cache is not cached.
+	c.add("d", loc(5), []byte("4444"))
+	if _, ok := c.get("d", loc(5)); ok {
+		t.Errorf("get(%q) of too big value hit", "d")
+	}
+
+	stats := c.stats()
+	if stats.Hits != 3 || stats.Misses != 4 || stats.Size != 4 {
+		t.Errorf("stats() = %+v, want 3 hits, 4 misses, size 4", stats)
+	}
+}
+
+func TestDB_Get_cache(t *testing.T) {
+	dbpath := "testdata/cache.db"
+	db, err := OpenWithOptions(dbpath, &Options{CacheSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err = db.Set("name", []byte("Bob")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		got, err := db.Get("name")
+		if err != nil || !bytes.Equal(got, []byte("Bob")) {
+			t.Errorf("Get(%q) = %q, %v, want %q", "name", got, err, "Bob")
+		}
+		// The caller can't modify the cached value.
+		got[0] = 'J'
+	}
+	if stats := db.CacheStats(); stats.Hits != 1 || stats.Misses != 1 {
+		t.Errorf("CacheStats() = %+v, want 1 hit and 1 miss", stats)
+	}
+
+	// Writes invalidate the cached value.
+	if err = db.Set("name", []byte("Rob")); err != nil {
+		t.Fatal(err)
+	}
+	if stats := db.CacheStats(); stats.Size != 0 {
+		t.Errorf("CacheStats() size %d after Set, want 0", stats.Size)
+	}
+	if got, err := db.Get("name"); err != nil || !bytes.Equal(got, []byte("Rob")) {
+		t.Errorf("Get(%q) = %q, %v, want %q", "name", got, err, "Rob")
+	}
+	if err = db.Delete("name"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := db.Get("name"); err != ErrKeyNotFound {
+		t.Errorf("Get(%q) = %q, %v, want %v", "name", got, err, ErrKeyNotFound)
+	}
+	if swapped, err := db.CompareAndSwap("name", nil, []byte("Jon")); swapped || err != nil {
+		t.Errorf("CompareAndSwap() = %t, %v, want false", swapped, err)
+	}
+	if _, err = db.Get("age"); err != ErrKeyNotFound {
+		t.Errorf("Get(%q) error %v, want %v", "age", err, ErrKeyNotFound)
+	}
+	// Deleted and not found keys are not read from disk, so they aren't misses.
+	if stats := db.CacheStats(); stats.Misses != 2 {
+		t.Errorf("CacheStats() = %+v, want 2 misses", stats)
+	}
+
+	teardown()
+}
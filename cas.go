@@ -0,0 +1,72 @@
+package rascaldb
+
+import (
+	"bytes"
+	"context"
+)
+
+// CompareAndSwap sets the key to the new value if the key's current value is equal to the old one.
+// It reports whether the value was swapped. A key which doesn't exist is never swapped, see SetIfAbsent.
+// The comparison and the write are executed in the actor, so no other writer can modify the key in between.
+func (db *DB) CompareAndSwap(key string, old, new []byte) (bool, error) {
+	return db.CompareAndSwapContext(context.Background(), key, old, new)
+}
+
+// CompareAndSwapContext is like CompareAndSwap, but it returns ctx.Err() when the context is done
+// before the key is swapped. Note, the key could have been swapped anyway if the context was canceled during the write.
+func (db *DB) CompareAndSwapContext(ctx context.Context, key string, old, new []byte) (swapped bool, err error) {
+	err = db.do(ctx, func() error {
+		ss := db.segments.Load().([]*segment)
+		value, err := locate(ss, key).read()
+		if err == ErrKeyNotFound || (err == nil && !bytes.Equal(value, old)) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		current, err := db.current()
+		if err != nil {
+			return err
+		}
+		err = current.write(key, new)
+		db.cache.remove(key)
+		if err != nil {
+			return err
+		}
+		swapped = true
+		return nil
+	})
+	return swapped, err
+}
+
+// SetIfAbsent puts a key in database only if the key doesn't exist, was deleted, or has expired.
+// It reports whether the key was set.
+// Like CompareAndSwap, the check and the write are executed atomically in the actor.
+func (db *DB) SetIfAbsent(key string, value []byte) (bool, error) {
+	return db.SetIfAbsentContext(context.Background(), key, value)
+}
+
+// SetIfAbsentContext is like SetIfAbsent, but it returns ctx.Err() when the context is done before the key is set.
+// Note, the key could have been set anyway if the context was canceled during the write.
+func (db *DB) SetIfAbsentContext(ctx context.Context, key string, value []byte) (ok bool, err error) {
+	err = db.do(ctx, func() error {
+		ss := db.segments.Load().([]*segment)
+		if _, err := locate(ss, key).read(); err != ErrKeyNotFound {
+			return err
+		}
+
+		current, err := db.current()
+		if err != nil {
+			return err
+		}
+		err = current.write(key, value)
+		db.cache.remove(key)
+		if err != nil {
+			return err
+		}
+		ok = true
+		return nil
+	})
+	return ok, err
+}
@@ -0,0 +1,99 @@
+package rascaldb
+
+import (
+	"bytes"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestDB_CompareAndSwap(t *testing.T) {
+	dbpath := "testdata/cas.db"
+	db, err := Open(dbpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if swapped, err := db.CompareAndSwap("a", nil, []byte("1")); swapped || err != nil {
+		t.Errorf("CompareAndSwap() of missing key = %t, %v, want false", swapped, err)
+	}
+	if err = db.Set("a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if swapped, err := db.CompareAndSwap("a", []byte("2"), []byte("3")); swapped || err != nil {
+		t.Errorf("CompareAndSwap() with different old value = %t, %v, want false", swapped, err)
+	}
+	if swapped, err := db.CompareAndSwap("a", []byte("1"), []byte("2")); !swapped || err != nil {
+		t.Errorf("CompareAndSwap() = %t, %v, want true", swapped, err)
+	}
+	if got, err := db.Get("a"); err != nil || !bytes.Equal(got, []byte("2")) {
+		t.Errorf("Get(%q) = %q, %v, want %q", "a", got, err, "2")
+	}
+
+	// Concurrent increments must not lose updates.
+	if err = db.Set("counter", []byte("0")); err != nil {
+		t.Fatal(err)
+	}
+	const workers, increments = 8, 20
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < increments; {
+				old, err := db.Get("counter")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				n, _ := strconv.Atoi(string(old))
+				swapped, err := db.CompareAndSwap("counter", old, []byte(strconv.Itoa(n+1)))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if swapped {
+					j++
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if got, err := db.Get("counter"); err != nil || string(got) != strconv.Itoa(workers*increments) {
+		t.Errorf("Get(%q) = %q, %v, want %d", "counter", got, err, workers*increments)
+	}
+
+	teardown()
+}
+
+func TestDB_SetIfAbsent(t *testing.T) {
+	dbpath := "testdata/cas.db"
+	db, err := Open(dbpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if ok, err := db.SetIfAbsent("a", []byte("1")); !ok || err != nil {
+		t.Errorf("SetIfAbsent() = %t, %v, want true", ok, err)
+	}
+	if ok, err := db.SetIfAbsent("a", []byte("2")); ok || err != nil {
+		t.Errorf("SetIfAbsent() of existing key = %t, %v, want false", ok, err)
+	}
+	if got, err := db.Get("a"); err != nil || !bytes.Equal(got, []byte("1")) {
+		t.Errorf("Get(%q) = %q, %v, want %q", "a", got, err, "1")
+	}
+
+	if err = db.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := db.SetIfAbsent("a", []byte("3")); !ok || err != nil {
+		t.Errorf("SetIfAbsent() of deleted key = %t, %v, want true", ok, err)
+	}
+	if got, err := db.Get("a"); err != nil || !bytes.Equal(got, []byte("3")) {
+		t.Errorf("Get(%q) = %q, %v, want %q", "a", got, err, "3")
+	}
+
+	teardown()
+}
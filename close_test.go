@@ -0,0 +1,175 @@
+package rascaldb
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDB_Close(t *testing.T) {
+	dbpath := "testdata/close.db"
+	db, err := Open(dbpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Close(); err != nil {
+		t.Errorf("Close() error %v", err)
+	}
+	if err = db.Close(); err != ErrClosed {
+		t.Errorf("Close() twice error %v, want %v", err, ErrClosed)
+	}
+
+	if err = db.Set("a", []byte("1")); err != ErrClosed {
+		t.Errorf("Set() error %v, want %v", err, ErrClosed)
+	}
+	if err = db.Delete("a"); err != ErrClosed {
+		t.Errorf("Delete() error %v, want %v", err, ErrClosed)
+	}
+	var b Batch
+	b.Set("a", []byte("1"))
+	if err = db.Write(&b); err != ErrClosed {
+		t.Errorf("Write() error %v, want %v", err, ErrClosed)
+	}
+	if _, err = db.Get("a"); err != ErrClosed {
+		t.Errorf("Get() error %v, want %v", err, ErrClosed)
+	}
+	if _, err = db.Snapshot(); err != ErrClosed {
+		t.Errorf("Snapshot() error %v, want %v", err, ErrClosed)
+	}
+	if err = db.Compact(); err != ErrClosed {
+		t.Errorf("Compact() error %v, want %v", err, ErrClosed)
+	}
+	if err = db.Sync(); err != ErrClosed {
+		t.Errorf("Sync() error %v, want %v", err, ErrClosed)
+	}
+
+	teardown()
+}
+
+func TestDB_Close_concurrent(t *testing.T) {
+	dbpath := "testdata/close.db"
+	db, err := Open(dbpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Writers keep writing until the db is closed.
+	const writers = 8
+	written := make([][]string, writers)
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; ; j++ {
+				key := fmt.Sprintf("%d-%d", i, j)
+				err := db.Set(key, []byte(key))
+				if err == ErrClosed {
+					return
+				}
+				if err != nil {
+					t.Errorf("Set(%q) error %v", key, err)
+					return
+				}
+				written[i] = append(written[i], key)
+			}
+		}(i)
+	}
+	for {
+		if v, _ := db.Get(fmt.Sprintf("%d-%d", writers-1, 10)); v != nil {
+			break
+		}
+	}
+	if err = db.Close(); err != nil {
+		t.Errorf("Close() error %v", err)
+	}
+	wg.Wait()
+
+	// Every acknowledged write must be stored.
+	if db, err = Open(dbpath); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, keys := range written {
+		for _, key := range keys {
+			if _, err = db.Get(key); err != nil {
+				t.Errorf("Get(%q) error %v", key, err)
+			}
+		}
+	}
+
+	teardown()
+}
+
+func TestDB_Close_compact(t *testing.T) {
+	dbpath := "testdata/close.db"
+	// The compaction is paused when it names a new segment.
+	var (
+		pause   atomic.Bool
+		paused  = make(chan struct{})
+		unpause = make(chan struct{})
+		namer   = newSegmentNamer()
+	)
+	namerFunc := func() string {
+		if pause.Load() {
+			close(paused)
+			<-unpause
+		}
+		return namer()
+	}
+	// Segment header is 16 bytes and every record is 15 bytes long, so each segment fits two records.
+	db, err := OpenWithOptions(dbpath, &Options{MaxSegmentSize: 46, SegmentNamer: namerFunc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, kv := range [][2]string{{"a", "1"}, {"a", "2"}, {"b", "3"}} {
+		if err = db.Set(kv[0], []byte(kv[1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pause.Store(true)
+	compacted := make(chan error, 1)
+	go func() {
+		compacted <- db.Compact()
+	}()
+	<-paused
+	closed := make(chan error, 1)
+	go func() {
+		closed <- db.Close()
+	}()
+	select {
+	case <-closed:
+		t.Fatal("Close() returned before the compaction finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+	// Reads and writes agree that db is still open until the compaction is finished.
+	if err = db.Set("c", []byte("4")); err != nil {
+		t.Errorf("Set() during Close error %v", err)
+	}
+	if got, err := db.Get("c"); err != nil || !bytes.Equal(got, []byte("4")) {
+		t.Errorf("Get(%q) during Close = %q, %v, want %q", "c", got, err, "4")
+	}
+	close(unpause)
+	if err = <-compacted; err != nil {
+		t.Errorf("Compact() error %v", err)
+	}
+	if err = <-closed; err != nil {
+		t.Errorf("Close() error %v", err)
+	}
+
+	if db, err = Open(dbpath); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for key, want := range map[string]string{"a": "2", "b": "3", "c": "4"} {
+		if got, err := db.Get(key); err != nil || !bytes.Equal(got, []byte(want)) {
+			t.Errorf("Get(%q) = %q, %v, want %q", key, got, err, want)
+		}
+	}
+
+	teardown()
+}
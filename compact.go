@@ -0,0 +1,233 @@
+package rascaldb
+
+import (
+	"context"
+	"path/filepath"
+	"time"
+)
+
+// Compact rewrites sealed segments which have stale records (old records of overwritten keys)
+// or expired keys, so only the latest unexpired record of every key is kept on disk.
+// Tombstones are dropped when older segments don't have the deleted keys.
+// Segments are rewritten in the caller's goroutine without blocking reads and writes,
+// hence Compact can be run in background.
+func (db *DB) Compact() error {
+	return db.CompactContext(context.Background())
+}
+
+// CompactContext is like Compact, but it stops and returns ctx.Err() when the context is done.
+// Segments which were compacted before that remain compacted.
+func (db *DB) CompactContext(ctx context.Context) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	db.compactMu.Lock()
+	defer db.compactMu.Unlock()
+	// Close waits for the compaction to finish, so db can't be closed until compactMu is released.
+	if db.closed.Load() {
+		return ErrClosed
+	}
+
+	ss := db.segments.Load().([]*segment)
+	now := time.Now().UnixNano()
+	// The last segment is not compacted since records are still appended to it.
+	for i, s := range ss[:len(ss)-1] {
+		// All tombstones of the oldest segment can be dropped since there is nothing left to shadow.
+		if s.stale == 0 && (i != 0 || s.deleted == 0) && !s.hasExpired(now) {
+			continue
+		}
+		if err := db.merge(ctx, []*segment{s}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Merge merges adjacent sealed segments into one segment as long as their total size
+// doesn't exceed max segment size. Fewer segments mean fewer index lookups and open files.
+// Like Compact, it doesn't block reads and writes and can be run in background.
+func (db *DB) Merge() error {
+	return db.MergeContext(context.Background())
+}
+
+// MergeContext is like Merge, but it stops and returns ctx.Err() when the context is done.
+func (db *DB) MergeContext(ctx context.Context) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	db.compactMu.Lock()
+	defer db.compactMu.Unlock()
+	// Close waits for the compaction to finish, so db can't be closed until compactMu is released.
+	if db.closed.Load() {
+		return ErrClosed
+	}
+
+	ss := db.segments.Load().([]*segment)
+	var (
+		group     []*segment
+		groupSize int64
+	)
+	// The last segment is not merged since records are still appended to it.
+	for _, s := range ss[:len(ss)-1] {
+		size, err := s.size()
+		if err != nil {
+			return err
+		}
+
+		if groupSize+size > db.maxSegmentSize {
+			if err = db.mergeGroup(ctx, group); err != nil {
+				return err
+			}
+			group, groupSize = nil, 0
+		}
+		group = append(group, s)
+		groupSize += size
+	}
+	return db.mergeGroup(ctx, group)
+}
+
+// mergeGroup merges segments if there are at least two of them.
+func (db *DB) mergeGroup(ctx context.Context, group []*segment) error {
+	if len(group) < 2 {
+		return nil
+	}
+	return db.merge(ctx, group)
+}
+
+// merge writes the latest records of the adjacent sealed segments olds into a new segment,
+// replaces the olds with the new segment, and deletes the old segment files unless snapshots reference them.
+func (db *DB) merge(ctx context.Context, olds []*segment) error {
+	ss := db.segments.Load().([]*segment)
+	i := indexOfSegments(ss, olds)
+	if i == -1 {
+		return ErrSegmentNotFound
+	}
+
+	s, err := db.createSegment()
+	if err != nil {
+		return err
+	}
+	err = copyLatest(ctx, olds, ss[:i], s)
+	// The segments are replaced regardless of the context, otherwise the new segment
+	// could be removed below after it was swapped in by the actor.
+	if err == nil {
+		err = db.do(context.Background(), func() error {
+			return db.replace(olds, s)
+		})
+	}
+	if err != nil {
+		s.remove()
+		return err
+	}
+
+	return db.retire(olds)
+}
+
+// copyLatest copies the latest records of src segments into dst segment, seals it, and writes its hint file.
+// Segments are traversed from the newest to the oldest, so a key found in a newer segment
+// shadows the same key in older ones. Stale records are not referenced by indexes, so they are dropped.
+// Tombstones are kept only if the deleted keys can be found in older segments.
+// Expired records are treated as tombstones, so older records of the keys don't reappear.
+// Copying stops when the context is done.
+func copyLatest(ctx context.Context, src, older []*segment, dst *segment) error {
+	now := time.Now().UnixNano()
+	seen := make(map[string]struct{})
+	for i := len(src) - 1; i >= 0; i-- {
+		for key, e := range src[i].index {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+
+			var b []byte
+			if e.deleted || e.expired(now) {
+				if !hasKey(older, key) {
+					continue
+				}
+				b = encodeTombstone(key)
+				e = entry{deleted: true}
+			} else {
+				_, value, err := src[i].read(e.offset)
+				if err != nil {
+					return err
+				}
+				// v1 records written by older versions could be larger than v2 record.
+				if err = checkRecordLen(key, value); err != nil {
+					return err
+				}
+				b = encodeExpiring(key, value, e.expires)
+			}
+
+			offset, err := dst.append(b)
+			if err != nil {
+				return err
+			}
+			e.offset, e.size = offset, uint32(len(b))
+			dst.put(key, e)
+		}
+	}
+
+	if err := dst.seal(); err != nil {
+		return err
+	}
+	return dst.writeHint()
+}
+
+// hasExpired reports whether the segment has any expired records by now (Unix nanoseconds).
+func (s *segment) hasExpired(now int64) bool {
+	if s.expiring == 0 {
+		return false
+	}
+	for _, e := range s.index {
+		if e.expired(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasKey reports whether any of the segments has the key indexed.
+func hasKey(ss []*segment, key string) bool {
+	for _, s := range ss {
+		if _, ok := s.index[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// replace swaps the adjacent old segments with the new one and stores segment names in the trunk.
+// Note, it must be called only from the actor.
+func (db *DB) replace(olds []*segment, s *segment) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	ss := db.segments.Load().([]*segment)
+	i := indexOfSegments(ss, olds)
+	if i == -1 {
+		return ErrSegmentNotFound
+	}
+	next := make([]*segment, 0, len(ss)-len(olds)+1)
+	next = append(next, ss[:i]...)
+	next = append(next, s)
+	next = append(next, ss[i+len(olds):]...)
+
+	if err := writeSegmentNames(filepath.Join(db.name, trunk), segmentNames(next), db.fileMode); err != nil {
+		return err
+	}
+	db.segments.Store(next)
+	return nil
+}
+
+// indexOfSegments returns the index of the first occurrence of sub slice in ss, or -1 if not present.
+func indexOfSegments(ss, sub []*segment) int {
+	for i := 0; i+len(sub) <= len(ss); i++ {
+		if sameSegments(ss[i:i+len(sub)], sub) {
+			return i
+		}
+	}
+	return -1
+}
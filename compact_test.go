@@ -0,0 +1,312 @@
+package rascaldb
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDB_Compact(t *testing.T) {
+	dbpath := "testdata/compact.db"
+	// Segment header is 16 bytes and every record is 15 bytes long, so each segment fits two records.
+	db, err := OpenWithOptions(dbpath, &Options{MaxSegmentSize: 46})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kv := []struct {
+		key   string
+		value string
+	}{
+		{"a", "1"},
+		{"a", "2"},
+		{"b", "1"},
+		{"b", "2"},
+		{"c", "1"},
+	}
+	for _, tc := range kv {
+		if err = db.Set(tc.key, []byte(tc.value)); err != nil {
+			t.Fatalf("Set(%q, %q) error %v", tc.key, tc.value, err)
+		}
+	}
+
+	before := db.segments.Load().([]*segment)
+	if err = db.Compact(); err != nil {
+		t.Fatalf("Compact() error %v", err)
+	}
+	after := db.segments.Load().([]*segment)
+
+	if len(after) != len(before) {
+		t.Fatalf("Compact() got segments %d, want %d", len(after), len(before))
+	}
+	for i, s := range before[:len(before)-1] {
+		if after[i] == s {
+			t.Errorf("Compact() segment %q was not replaced", s.name)
+		}
+		if _, err = os.Stat(s.name); !os.IsNotExist(err) {
+			t.Errorf("Compact() segment file %q was not removed", s.name)
+		}
+		if _, err = os.Stat(hintName(s.name)); !os.IsNotExist(err) {
+			t.Errorf("Compact() hint file of %q was not removed", s.name)
+		}
+		if _, err = os.Stat(hintName(after[i].name)); err != nil {
+			t.Errorf("Compact() hint file of %q: %v", after[i].name, err)
+		}
+		if after[i].stale != 0 || len(after[i].index) != 1 {
+			t.Errorf("Compact() segment %q has %d stale records and %d keys, want 0 and 1", after[i].name, after[i].stale, len(after[i].index))
+		}
+	}
+	if last := len(after) - 1; after[last] != before[last] {
+		t.Errorf("Compact() current segment was replaced")
+	}
+
+	names, err := readSegmentNames("testdata/compact.db/trunk.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := segmentNames(after); !equal(names, want) {
+		t.Errorf("Compact() trunk %q, want %q", names, want)
+	}
+	db.Close()
+
+	if db, err = Open(dbpath); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	want := map[string]string{"a": "2", "b": "2", "c": "1"}
+	for k, v := range want {
+		got, err := db.Get(k)
+		if err != nil {
+			t.Errorf("Get(%q) error %v", k, err)
+		}
+		if !bytes.Equal(got, []byte(v)) {
+			t.Errorf("Get(%q) = %q, want %q", k, got, v)
+		}
+	}
+
+	teardown()
+}
+
+func TestDB_Merge(t *testing.T) {
+	dbpath := "testdata/compact.db"
+	// Segment header is 16 bytes and every record is 15 bytes long, so each segment fits two records.
+	db, err := OpenWithOptions(dbpath, &Options{MaxSegmentSize: 46})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv := []struct {
+		key   string
+		value string
+	}{
+		{"a", "1"},
+		{"a", "2"},
+		{"b", "1"},
+		{"a", "3"},
+		{"c", "1"},
+	}
+	for _, tc := range kv {
+		if err = db.Set(tc.key, []byte(tc.value)); err != nil {
+			t.Fatalf("Set(%q, %q) error %v", tc.key, tc.value, err)
+		}
+	}
+	db.Close()
+
+	// Segments are small enough to be merged when max segment size is increased.
+	if db, err = OpenWithOptions(dbpath, &Options{MaxSegmentSize: 200}); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	before := db.segments.Load().([]*segment)
+	if err = db.Merge(); err != nil {
+		t.Fatalf("Merge() error %v", err)
+	}
+	after := db.segments.Load().([]*segment)
+
+	wantLen := 2
+	if len(after) != wantLen {
+		t.Fatalf("Merge() got segments %d, want %d", len(after), wantLen)
+	}
+	for _, s := range before[:len(before)-1] {
+		if _, err = os.Stat(s.name); !os.IsNotExist(err) {
+			t.Errorf("Merge() segment file %q was not removed", s.name)
+		}
+	}
+	if after[1] != before[len(before)-1] {
+		t.Errorf("Merge() current segment was replaced")
+	}
+	if len(after[0].index) != 2 || after[0].stale != 0 {
+		t.Errorf("Merge() merged segment has %d keys and %d stale records, want 2 and 0", len(after[0].index), after[0].stale)
+	}
+
+	names, err := readSegmentNames("testdata/compact.db/trunk.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := segmentNames(after); !equal(names, want) {
+		t.Errorf("Merge() trunk %q, want %q", names, want)
+	}
+
+	want := map[string]string{"a": "3", "b": "1", "c": "1"}
+	for k, v := range want {
+		got, err := db.Get(k)
+		if err != nil {
+			t.Errorf("Get(%q) error %v", k, err)
+		}
+		if !bytes.Equal(got, []byte(v)) {
+			t.Errorf("Get(%q) = %q, want %q", k, got, v)
+		}
+	}
+
+	teardown()
+}
+
+func TestDB_Merge_tombstones(t *testing.T) {
+	dbpath := "testdata/compact.db"
+	db, err := OpenWithOptions(dbpath, &Options{MaxSegmentSize: 46})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Set("a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Set("b", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	// The tombstone shadows a=1 in the oldest segment.
+	if err = db.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Set("c", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Set("d", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	if db, err = OpenWithOptions(dbpath, &Options{MaxSegmentSize: 200}); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// The tombstones aren't needed after the segments are merged.
+	if err = db.Merge(); err != nil {
+		t.Fatalf("Merge() error %v", err)
+	}
+	segments := db.segments.Load().([]*segment)
+	if len(segments) != 2 {
+		t.Fatalf("Merge() got segments %d, want 2", len(segments))
+	}
+	if n := len(segments[0].index); n != 1 || segments[0].deleted != 0 {
+		t.Errorf("Merge() merged segment has %d keys and %d tombstones, want 1 and 0", n, segments[0].deleted)
+	}
+	for _, k := range []string{"a", "b"} {
+		if got, err := db.Get(k); err != ErrKeyNotFound {
+			t.Errorf("Get(%q) = %q, %v, want %v", k, got, err, ErrKeyNotFound)
+		}
+	}
+
+	teardown()
+}
+
+func TestDB_Compact_tombstones(t *testing.T) {
+	dbpath := "testdata/compact.db"
+	db, err := OpenWithOptions(dbpath, &Options{MaxSegmentSize: 46})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err = db.Set("a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Set("b", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Set("c", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Set("c", []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Set("d", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Tombstone of the second segment must be kept since the oldest segment has the key.
+	if err = db.Compact(); err != nil {
+		t.Fatalf("Compact() error %v", err)
+	}
+	if got, err := db.Get("a"); err != ErrKeyNotFound {
+		t.Errorf("Get(%q) = %q, %v, want %v", "a", got, err, ErrKeyNotFound)
+	}
+	segments := db.segments.Load().([]*segment)
+	if segments[1].stale != 0 {
+		t.Errorf("Compact() second segment has %d stale records, want 0", segments[1].stale)
+	}
+	if _, ok := segments[1].index["a"]; !ok {
+		t.Errorf("Compact() dropped tombstone which shadows the oldest segment")
+	}
+
+	teardown()
+}
+
+func TestDB_Compact_expired(t *testing.T) {
+	dbpath := "testdata/compact.db"
+	// Segment header is 16 bytes, a record is 15 bytes long and an expiring record is 23 bytes long.
+	db, err := OpenWithOptions(dbpath, &Options{MaxSegmentSize: 40})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err = db.Set("a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Set("b", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.SetWithTTL("a", []byte("2"), -time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.SetWithTTL("c", []byte("1"), -time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Set("d", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if segments := db.segments.Load().([]*segment); len(segments) != 3 {
+		t.Fatalf("got segments %d, want 3", len(segments))
+	}
+
+	if err = db.Compact(); err != nil {
+		t.Fatalf("Compact() error %v", err)
+	}
+	// Expired key "a" becomes a tombstone since the oldest segment has the key,
+	// and expired key "c" is dropped.
+	s := db.segments.Load().([]*segment)[1]
+	if e, ok := s.index["a"]; !ok || !e.deleted {
+		t.Errorf("Compact() expired key %q entry %+v, want tombstone", "a", e)
+	}
+	if _, ok := s.index["c"]; ok {
+		t.Errorf("Compact() expired key %q was not dropped", "c")
+	}
+	if s.expiring != 0 {
+		t.Errorf("Compact() segment has %d expiring records, want 0", s.expiring)
+	}
+	for _, k := range []string{"a", "c"} {
+		if got, err := db.Get(k); err != ErrKeyNotFound {
+			t.Errorf("Get(%q) = %q, %v, want %v", k, got, err, ErrKeyNotFound)
+		}
+	}
+
+	teardown()
+}
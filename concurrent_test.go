@@ -0,0 +1,104 @@
+package rascaldb
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// TestDB_concurrent is meant to be run with the race detector.
+// Readers look up keys while the actor writes them, rotates segments, and compaction replaces them.
+func TestDB_concurrent(t *testing.T) {
+	dbpath := "testdata/concurrent.db"
+	db, err := OpenWithOptions(dbpath, &Options{MaxSegmentSize: 1024, OrderedIndex: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	const writes = 500
+	var (
+		wg   sync.WaitGroup
+		done = make(chan struct{})
+	)
+	// The writer sets keys x and y to the same value in a batch.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+		for i := 1; i <= writes; i++ {
+			var b Batch
+			b.Set("x", []byte(strconv.Itoa(i)))
+			b.Set("y", []byte(strconv.Itoa(i)))
+			if err := db.Write(&b); err != nil {
+				t.Error(err)
+				return
+			}
+			if err := db.Set(strconv.Itoa(i), nil); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if err := db.Compact(); err != nil {
+				t.Error(err)
+				return
+			}
+			if err := db.Merge(); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	// Readers must see batches applied completely: x is written first, so y can't be older than x.
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				x, errx := db.Get("x")
+				y, erry := db.Get("y")
+				if errx == ErrKeyNotFound {
+					continue
+				}
+				if errx != nil || erry != nil {
+					t.Errorf("Get() error %v %v", errx, erry)
+					return
+				}
+				if xn, yn := atoi(x), atoi(y); yn < xn {
+					t.Errorf("Get() y=%d is older than x=%d", yn, xn)
+					return
+				}
+				for range db.ScanPrefix("1") {
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got, err := db.Get("y"); err != nil || atoi(got) != writes {
+		t.Errorf("Get(%q) = %q, %v, want %d", "y", got, err, writes)
+	}
+
+	teardown()
+}
+
+func atoi(b []byte) int {
+	n, _ := strconv.Atoi(string(b))
+	return n
+}
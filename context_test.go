@@ -0,0 +1,211 @@
+package rascaldb
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDB_SetContext(t *testing.T) {
+	dbpath := "testdata/context.db"
+	db, err := Open(dbpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err = db.SetContext(ctx, "a", []byte("1")); err != context.Canceled {
+		t.Errorf("SetContext() error %v, want %v", err, context.Canceled)
+	}
+	if _, err = db.GetContext(ctx, "a"); err != context.Canceled {
+		t.Errorf("GetContext() error %v, want %v", err, context.Canceled)
+	}
+
+	// The actor is busy, so the write can't be started before the deadline.
+	unblock := make(chan struct{})
+	busy := make(chan struct{})
+	go db.do(context.Background(), func() error {
+		close(busy)
+		<-unblock
+		return nil
+	})
+	<-busy
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err = db.SetContext(ctx, "a", []byte("1")); err != context.DeadlineExceeded {
+		t.Errorf("SetContext() error %v, want %v", err, context.DeadlineExceeded)
+	}
+	if err = db.DeleteContext(ctx, "a"); err != context.DeadlineExceeded {
+		t.Errorf("DeleteContext() error %v, want %v", err, context.DeadlineExceeded)
+	}
+	var b Batch
+	b.Set("a", []byte("1"))
+	if err = db.WriteContext(ctx, &b); err != context.DeadlineExceeded {
+		t.Errorf("WriteContext() error %v, want %v", err, context.DeadlineExceeded)
+	}
+	close(unblock)
+
+	if _, err = db.GetContext(context.Background(), "a"); err != ErrKeyNotFound {
+		t.Errorf("GetContext() error %v, want %v", err, ErrKeyNotFound)
+	}
+	if err = db.SetContext(context.Background(), "a", []byte("1")); err != nil {
+		t.Errorf("SetContext() error %v", err)
+	}
+
+	teardown()
+}
+
+func TestDB_WriteContext_reuse(t *testing.T) {
+	dbpath := "testdata/context.db"
+	db, err := Open(dbpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// The batch and the value are reused as soon as the write returns,
+	// even when the context was canceled while the actor was writing them.
+	var b Batch
+	value := []byte("value")
+	for i := 0; i < 100; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		go cancel()
+		b.Reset()
+		b.Set("batch", []byte("value"))
+		db.WriteContext(ctx, &b)
+		b.Reset()
+		b.Set("batch", []byte("wrong"))
+
+		copy(value, "value")
+		db.SetContext(ctx, "set", value)
+		copy(value, "wrong")
+	}
+
+	for _, key := range []string{"batch", "set"} {
+		got, err := db.Get(key)
+		if err != nil && err != ErrKeyNotFound {
+			t.Fatalf("Get(%q) error %v", key, err)
+		}
+		if err == nil && !bytes.Equal(got, []byte("value")) {
+			t.Errorf("Get(%q) = %q, want %q", key, got, "value")
+		}
+	}
+
+	teardown()
+}
+
+func TestDB_CompactContext(t *testing.T) {
+	dbpath := "testdata/context.db"
+	// Segment header is 16 bytes and every record is 15 bytes long, so each segment fits two records.
+	db, err := OpenWithOptions(dbpath, &Options{MaxSegmentSize: 46})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, v := range []string{"1", "2", "3"} {
+		if err = db.Set("a", []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	before := db.segments.Load().([]*segment)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err = db.CompactContext(ctx); err != context.Canceled {
+		t.Errorf("CompactContext() error %v, want %v", err, context.Canceled)
+	}
+	if after := db.segments.Load().([]*segment); !sameSegments(before, after) {
+		t.Errorf("CompactContext() replaced segments after cancellation")
+	}
+
+	teardown()
+}
+
+func TestDB_Context_canceled(t *testing.T) {
+	dbpath := "testdata/context.db"
+	db, err := Open(dbpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err = db.Set("a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tt := map[string]func() error{
+		"SetWithTTLContext": func() error {
+			return db.SetWithTTLContext(ctx, "a", []byte("2"), time.Hour)
+		},
+		"CompareAndSwapContext": func() error {
+			_, err := db.CompareAndSwapContext(ctx, "a", []byte("1"), []byte("2"))
+			return err
+		},
+		"SetIfAbsentContext": func() error {
+			_, err := db.SetIfAbsentContext(ctx, "b", []byte("2"))
+			return err
+		},
+		"UpdateContext": func() error {
+			return db.UpdateContext(ctx, func(tx *Tx) error {
+				return tx.Set("a", []byte("2"))
+			})
+		},
+		"ViewContext": func() error {
+			return db.ViewContext(ctx, func(tx *Tx) error {
+				_, err := tx.Get("a")
+				return err
+			})
+		},
+		"SnapshotContext": func() error {
+			_, err := db.SnapshotContext(ctx)
+			return err
+		},
+		"SyncContext": func() error {
+			return db.SyncContext(ctx)
+		},
+	}
+	for name, f := range tt {
+		if err = f(); err != context.Canceled {
+			t.Errorf("%s() error %v, want %v", name, err, context.Canceled)
+		}
+	}
+	if got, err := db.Get("a"); err != nil || !bytes.Equal(got, []byte("1")) {
+		t.Errorf("Get(%q) = %q, %v, want %q", "a", got, err, "1")
+	}
+
+	// The snapshot abandoned while the actor was creating it must not keep referencing segments.
+	// The actor can't reference the segments until db.mu is unlocked.
+	db.mu.Lock()
+	ctx, cancel = context.WithCancel(context.Background())
+	errc := make(chan error)
+	go func() {
+		_, err := db.SnapshotContext(ctx)
+		errc <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	err = <-errc
+	db.mu.Unlock()
+	if err != context.Canceled {
+		t.Errorf("SnapshotContext() error %v, want %v", err, context.Canceled)
+	}
+	// The actor has handled the snapshot once it runs the next action.
+	if err = db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	db.mu.Lock()
+	for _, s := range db.segments.Load().([]*segment) {
+		if s.refs != 0 {
+			t.Errorf("segment %q has %d refs, want 0", s.name, s.refs)
+		}
+	}
+	db.mu.Unlock()
+
+	teardown()
+}
@@ -1,7 +1,34 @@
 package rascaldb
 
-// ErrKeyNotFound is returned when a requested key is not found in database.
-const ErrKeyNotFound = Error("key not found")
+const (
+	// ErrKeyNotFound is returned when a requested key is not found in database.
+	ErrKeyNotFound = Error("key not found")
+	// ErrSegmentNotFound is returned when segments being replaced are not found in database.
+	ErrSegmentNotFound = Error("segment not found")
+	// ErrCorrupted is returned when a record's checksum doesn't match, e.g., the record was partially written.
+	ErrCorrupted = Error("corrupted record")
+	// ErrSegmentHeader is returned when a segment file doesn't have a valid header, i.e., it is not a segment file.
+	ErrSegmentHeader = Error("invalid segment header")
+	// ErrSegmentVersion is returned when a segment file format version is not supported.
+	ErrSegmentVersion = Error("unsupported segment version")
+	// ErrTrunkCorrupted is returned when the trunk file was partially written or its checksum doesn't match.
+	ErrTrunkCorrupted = Error("corrupted trunk")
+	// ErrConflict is returned when a transaction couldn't be committed because the keys it read were modified.
+	// The transaction can be retried.
+	ErrConflict = Error("transaction conflict")
+	// ErrTxReadOnly is returned when a read-only transaction attempts to write.
+	ErrTxReadOnly = Error("transaction is read-only")
+	// ErrSnapshotReleased is returned when a snapshot is used after it was released.
+	ErrSnapshotReleased = Error("snapshot released")
+	// ErrReadOnly is returned when a database opened in read-only mode is modified.
+	ErrReadOnly = Error("database is read-only")
+	// ErrLocked is returned when a database is already opened by another process.
+	ErrLocked = Error("database is locked")
+	// ErrClosed is returned when a database is used after it was closed.
+	ErrClosed = Error("database is closed")
+	// ErrTooLarge is returned when a key-value pair doesn't fit into a record (2 GB).
+	ErrTooLarge = Error("key-value is too large")
+)
 
 // Error defines RascalDB errors.
 type Error string
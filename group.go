@@ -0,0 +1,94 @@
+package rascaldb
+
+import "context"
+
+// maxGroupWrites limits a number of writes flushed to disk together,
+// so the callers of the first writes in the group don't wait for too long.
+const maxGroupWrites = 256
+
+// writeRequest is a write waiting to be applied by the actor.
+// Set, Delete, and Write are turned into write requests, so concurrent writes can be grouped together.
+type writeRequest struct {
+	ctx context.Context
+	// batch is encoded by the caller, since the caller could reuse the Batch or the value
+	// once it stopped waiting for the write.
+	batch encodedBatch
+	// errc receives the result of the write. It is buffered, so the actor doesn't block
+	// when the caller stopped waiting.
+	errc chan error
+}
+
+// write sends the batch to the actor and waits until it is written.
+// It stops waiting and returns ctx.Err() when the context is done,
+// though the batch could have been written anyway if the context was canceled during the write.
+func (db *DB) write(ctx context.Context, b *Batch) error {
+	if db.closed.Load() {
+		return ErrClosed
+	}
+	batch, err := b.encode()
+	if err != nil {
+		return err
+	}
+	w := writeRequest{
+		ctx:   ctx,
+		batch: batch,
+		errc:  make(chan error, 1),
+	}
+	select {
+	case db.writesc <- &w:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-db.quitc:
+		return ErrClosed
+	}
+	select {
+	case err := <-w.errc:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// writeGroup appends the write w along with other pending writes to the current segment
+// with a single write and fsync, and then acknowledges every caller.
+// Batches remain atomic on their own, i.e., a group is not a batch.
+// Note, it must be called only from the actor.
+func (db *DB) writeGroup(w *writeRequest) {
+	group := []*writeRequest{w}
+drain:
+	for len(group) < maxGroupWrites {
+		select {
+		case w = <-db.writesc:
+			group = append(group, w)
+		default:
+			break drain
+		}
+	}
+
+	// Writes whose callers have given up are skipped.
+	pending := group[:0]
+	batches := make([]encodedBatch, 0, len(group))
+	for _, w := range group {
+		if err := w.ctx.Err(); err != nil {
+			w.errc <- err
+			continue
+		}
+		pending = append(pending, w)
+		batches = append(batches, w.batch)
+	}
+	if len(pending) == 0 {
+		return
+	}
+
+	current, err := db.current()
+	if err == nil {
+		err = current.writeBatches(batches)
+		db.invalidate(batches...)
+	}
+	if db.onWriteGroup != nil {
+		db.onWriteGroup(len(pending))
+	}
+	for _, w := range pending {
+		w.errc <- err
+	}
+}
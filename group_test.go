@@ -0,0 +1,132 @@
+package rascaldb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSegment_writeBatches(t *testing.T) {
+	s, err := openSegment("testdata/writesegment", true, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardown()
+	defer s.close()
+
+	var b Batch
+	b.Set("city", []byte("Ankh-Morpork"))
+	b.Set("name", []byte("Jon"))
+	var batches []encodedBatch
+	for _, batch := range []*Batch{
+		{ops: []batchOp{{key: "name", value: []byte("Bob")}}},
+		&b,
+		{ops: []batchOp{{key: "nick", deleted: true}}},
+	} {
+		eb, err := batch.encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		batches = append(batches, eb)
+	}
+	if err = s.writeBatches(batches); err != nil {
+		t.Fatalf("writeBatches() error %v", err)
+	}
+	if s.stale != 1 || s.deleted != 1 || len(s.index) != 3 {
+		t.Errorf("writeBatches() stale %d deleted %d keys %d, want 1 1 3", s.stale, s.deleted, len(s.index))
+	}
+	for key, want := range map[string]string{"city": "Ankh-Morpork", "name": "Jon"} {
+		if _, got, err := s.read(s.index[key].offset); err != nil || string(got) != want {
+			t.Errorf("read(%q) = %q, %v, want %q", key, got, err, want)
+		}
+	}
+
+	// The index must be the same when it's loaded from the segment file.
+	loaded, err := openSegment("testdata/writesegment", false, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loaded.close()
+	end, err := loaded.loadIndex()
+	if err != nil {
+		t.Fatalf("loadIndex() error %v", err)
+	}
+	if end != s.offset {
+		t.Errorf("loadIndex() end %d, want %d", end, s.offset)
+	}
+	if !reflect.DeepEqual(loaded.index, s.index) {
+		t.Errorf("loadIndex() index %v, want %v", loaded.index, s.index)
+	}
+}
+
+func TestDB_Set_concurrent(t *testing.T) {
+	dbpath := "testdata/group.db"
+	db, err := Open(dbpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Group sizes are recorded to make sure concurrent writes are flushed together.
+	var groups []int
+	db.onWriteGroup = func(n int) {
+		groups = append(groups, n)
+	}
+	// The actor is busy until the writers are waiting, so their first writes are grouped.
+	unblock := make(chan struct{})
+	busy := make(chan struct{})
+	go db.do(context.Background(), func() error {
+		close(busy)
+		<-unblock
+		return nil
+	})
+	<-busy
+
+	const writers, writes = 16, 50
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < writes; j++ {
+				key := fmt.Sprintf("%d-%d", i, j)
+				if err := db.Set(key, []byte(key)); err != nil {
+					t.Errorf("Set(%q) error %v", key, err)
+				}
+			}
+		}(i)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(unblock)
+	wg.Wait()
+
+	if len(groups) >= writers*writes || slices.Max(groups) < 2 {
+		t.Errorf("Set() wrote %d groups of up to %d writes, want writes grouped", len(groups), slices.Max(groups))
+	}
+
+	check := func() {
+		t.Helper()
+		for i := 0; i < writers; i++ {
+			for j := 0; j < writes; j++ {
+				key := fmt.Sprintf("%d-%d", i, j)
+				if got, err := db.Get(key); err != nil || !bytes.Equal(got, []byte(key)) {
+					t.Errorf("Get(%q) = %q, %v, want %q", key, got, err, key)
+				}
+			}
+		}
+	}
+	check()
+	db.Close()
+
+	if db, err = Open(dbpath); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check()
+
+	teardown()
+}
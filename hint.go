@@ -0,0 +1,128 @@
+package rascaldb
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+)
+
+// hintExt is appended to a segment filename to name its hint file.
+// Hint file stores the index of a sealed segment, so the index can be loaded
+// without reading every record of the segment when db is opened.
+//
+// Hint file is a sequence of entries followed by a trailer:
+//
+//	entry: flags (1 byte) | key length (4 bytes) | key | record offset (8 bytes) | record size (4 bytes) |
+//	       [expiration time (8 bytes)]
+//	trailer: segment end offset (8 bytes) | stale records (4 bytes) | CRC-32 checksum (4 bytes)
+const hintExt = ".hint"
+
+// hintTrailerSize is a size of the hint file trailer.
+const hintTrailerSize = 8 + 4 + checksumSize
+
+// hintName returns a hint filename of the segment.
+func hintName(segName string) string {
+	return segName + hintExt
+}
+
+// writeHint stores the index of the sealed segment in a hint file.
+func (s *segment) writeHint() error {
+	var b []byte
+	for key, e := range s.index {
+		var flags byte
+		if e.deleted {
+			flags |= flagTombstone
+		}
+		if e.expires != 0 {
+			flags |= flagExpires
+		}
+		b = append(b, flags)
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(key)))
+		b = append(b, key...)
+		b = binary.LittleEndian.AppendUint64(b, uint64(e.offset))
+		b = binary.LittleEndian.AppendUint32(b, e.size)
+		if e.expires != 0 {
+			b = binary.LittleEndian.AppendUint64(b, uint64(e.expires))
+		}
+	}
+	b = binary.LittleEndian.AppendUint64(b, uint64(s.offset))
+	b = binary.LittleEndian.AppendUint32(b, uint32(s.stale))
+	b = binary.LittleEndian.AppendUint32(b, crc32.ChecksumIEEE(b))
+
+	return writeFileSync(hintName(s.name), b, s.perm)
+}
+
+// loadHint loads keys from the segment's hint file into in-memory index.
+// Like loadIndex it returns the offset where the last record of the segment ends.
+// ErrCorrupted is returned when the hint's checksum doesn't match or it doesn't match the segment file,
+// in that case the index must be loaded with loadIndex.
+// Note, it is not concurrency safe since it touches the index.
+func (s *segment) loadHint() (int64, error) {
+	b, err := os.ReadFile(hintName(s.name))
+	if err != nil {
+		return 0, err
+	}
+	if len(b) < hintTrailerSize {
+		return 0, ErrCorrupted
+	}
+	crc := binary.LittleEndian.Uint32(b[len(b)-checksumSize:])
+	if crc != crc32.ChecksumIEEE(b[:len(b)-checksumSize]) {
+		return 0, ErrCorrupted
+	}
+
+	trailer := b[len(b)-hintTrailerSize:]
+	end := int64(binary.LittleEndian.Uint64(trailer))
+	stale := int(binary.LittleEndian.Uint32(trailer[8:]))
+	// The segment file must end where the hint says, otherwise the hint is of no use.
+	if size, err := s.size(); err != nil || size != end {
+		return 0, ErrCorrupted
+	}
+
+	index := make(map[string]entry)
+	var deleted, expiring int
+	b = b[:len(b)-hintTrailerSize]
+	for len(b) > 0 {
+		if len(b) < flagsSize+keyLenSize {
+			return 0, ErrCorrupted
+		}
+		flags := b[0]
+		klen := binary.LittleEndian.Uint32(b[flagsSize:])
+		b = b[flagsSize+keyLenSize:]
+		if uint64(len(b)) < uint64(klen)+8+4 {
+			return 0, ErrCorrupted
+		}
+
+		key := string(b[:klen])
+		b = b[klen:]
+		e := entry{
+			offset:  int64(binary.LittleEndian.Uint64(b)),
+			size:    binary.LittleEndian.Uint32(b[8:]),
+			deleted: flags&flagTombstone != 0,
+		}
+		b = b[8+4:]
+		if flags&flagExpires != 0 {
+			if len(b) < expiresSize {
+				return 0, ErrCorrupted
+			}
+			e.expires = int64(binary.LittleEndian.Uint64(b))
+			b = b[expiresSize:]
+			expiring++
+		}
+
+		if e.deleted {
+			deleted++
+		}
+		index[key] = e
+	}
+
+	s.index = index
+	if s.keys != nil {
+		for key := range index {
+			s.keys.insert(key)
+		}
+	}
+	s.stale = stale
+	s.deleted = deleted
+	s.expiring = expiring
+	return end, nil
+}
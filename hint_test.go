@@ -0,0 +1,152 @@
+package rascaldb
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func writeHintSegment(t *testing.T) *segment {
+	t.Helper()
+	s, err := openSegment("testdata/writesegment", true, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.write("name", []byte("Bob")); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.write("name", []byte("Jon")); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.delete("nick"); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.writeBatch(&Batch{ops: []batchOp{{key: "session", value: []byte("1"), expires: 1 << 62}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.seal(); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.writeHint(); err != nil {
+		t.Fatalf("writeHint() error %v", err)
+	}
+	return s
+}
+
+func TestSegment_loadHint(t *testing.T) {
+	written := writeHintSegment(t)
+	written.close()
+	defer teardown()
+
+	s, err := openSegment("testdata/writesegment", false, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+
+	end, err := s.loadHint()
+	if err != nil {
+		t.Fatalf("loadHint() error %v", err)
+	}
+	if end != written.offset {
+		t.Errorf("loadHint() end %d, want %d", end, written.offset)
+	}
+	if !reflect.DeepEqual(s.index, written.index) {
+		t.Errorf("loadHint() index %v, want %v", s.index, written.index)
+	}
+	if s.stale != written.stale || s.deleted != written.deleted || s.expiring != written.expiring {
+		t.Errorf("loadHint() stale %d deleted %d expiring %d, want %d %d %d",
+			s.stale, s.deleted, s.expiring, written.stale, written.deleted, written.expiring)
+	}
+}
+
+func TestSegment_loadHint_error(t *testing.T) {
+	s := writeHintSegment(t)
+	defer teardown()
+	defer s.close()
+
+	hint, err := ioutil.ReadFile(hintName(s.name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hint[0] ^= 0xff
+	if err = ioutil.WriteFile(hintName(s.name), hint, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.loadHint(); err != ErrCorrupted {
+		t.Errorf("loadHint() checksum mismatch got %v, want %v", err, ErrCorrupted)
+	}
+
+	// The hint doesn't describe the segment if the segment size is different.
+	hint[0] ^= 0xff
+	if err = ioutil.WriteFile(hintName(s.name), hint, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Truncate(s.name, s.offset-1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.loadHint(); err != ErrCorrupted {
+		t.Errorf("loadHint() size mismatch got %v, want %v", err, ErrCorrupted)
+	}
+
+	os.Remove(hintName(s.name))
+	if _, err = s.loadHint(); !os.IsNotExist(err) {
+		t.Errorf("loadHint() missing hint got %v, want not exist error", err)
+	}
+}
+
+func TestOpen_hint(t *testing.T) {
+	dbpath := "testdata/hint.db"
+	// Segment header is 16 bytes and every record is 15 bytes long, so each segment fits two records.
+	db, err := OpenWithOptions(dbpath, &Options{MaxSegmentSize: 46})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"a", "a", "b"} {
+		if err = db.Set(k, []byte("1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	segments := db.segments.Load().([]*segment)
+	sealed := segments[0].name
+	// The hint is written in the background after the segment was sealed.
+	segments[0].hinting.Wait()
+	if _, err = os.Stat(hintName(sealed)); err != nil {
+		t.Errorf("Set() hint of sealed segment: %v", err)
+	}
+	if _, err = os.Stat(hintName(segments[1].name)); !os.IsNotExist(err) {
+		t.Errorf("Set() current segment must not have a hint: %v", err)
+	}
+	db.Close()
+
+	// The hint is used to load the index, so the segment records are not read.
+	b, err := ioutil.ReadFile(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := segmentHeaderSize; i < len(b); i++ {
+		b[i] = 0
+	}
+	if err = ioutil.WriteFile(sealed, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = Open(dbpath); err != nil {
+		t.Fatalf("Open() error %v", err)
+	}
+	segments = db.segments.Load().([]*segment)
+	if e, ok := segments[0].index["a"]; !ok || e.offset != int64(segmentHeaderSize)+15 || segments[0].stale != 1 {
+		t.Errorf("Open() index wasn't loaded from hint: %v, stale %d", segments[0].index, segments[0].stale)
+	}
+	db.Close()
+
+	// Without the hint the segment is scanned.
+	if err = os.Remove(hintName(sealed)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Open(dbpath); err != ErrCorrupted {
+		t.Errorf("Open() got %v, want %v", err, ErrCorrupted)
+	}
+
+	teardown()
+}
@@ -0,0 +1,49 @@
+package rascaldb
+
+import "iter"
+
+// Iterate calls fn for every live key-value pair in database in no particular order.
+// Overwritten, deleted, and expired keys are skipped.
+// Database is iterated as of the time Iterate was called, so it is safe to write concurrently,
+// but the writes are not visible to the iteration.
+// The iteration stops when fn returns an error, and that error is returned by Iterate.
+func (db *DB) Iterate(fn func(key string, value []byte) error) error {
+	snap, err := db.Snapshot()
+	if err != nil {
+		return err
+	}
+	err = snap.Iterate(fn)
+	if rerr := snap.Release(); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// All returns an iterator over live key-value pairs in database like Iterate.
+// The iteration stops early if a record couldn't be read, use Iterate to get the error.
+func (db *DB) All() iter.Seq2[string, []byte] {
+	return func(yield func(string, []byte) bool) {
+		db.Iterate(func(key string, value []byte) error {
+			if !yield(key, value) {
+				return errStopIteration
+			}
+			return nil
+		})
+	}
+}
+
+// All returns an iterator over key-value pairs of the snapshot like Iterate.
+// The iteration stops early if a record couldn't be read, use Iterate to get the error.
+func (snap *Snapshot) All() iter.Seq2[string, []byte] {
+	return func(yield func(string, []byte) bool) {
+		snap.Iterate(func(key string, value []byte) error {
+			if !yield(key, value) {
+				return errStopIteration
+			}
+			return nil
+		})
+	}
+}
+
+// errStopIteration is used to stop Iterate or a scan when the consumer of an iterator breaks the loop.
+const errStopIteration = Error("stop iteration")
@@ -0,0 +1,90 @@
+package rascaldb
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDB_Iterate(t *testing.T) {
+	dbpath := "testdata/iterate.db"
+	// Segment header is 16 bytes and every record is 15 bytes long, so each segment fits two records.
+	db, err := OpenWithOptions(dbpath, &Options{MaxSegmentSize: 46})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	kv := []struct {
+		key   string
+		value string
+	}{
+		{"a", "1"},
+		{"b", "1"},
+		{"a", "2"},
+		{"c", "1"},
+		{"d", "1"},
+	}
+	for _, tc := range kv {
+		if err = db.Set(tc.key, []byte(tc.value)); err != nil {
+			t.Fatalf("Set(%q, %q) error %v", tc.key, tc.value, err)
+		}
+	}
+	if err = db.Delete("c"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"a": "2", "b": "1", "d": "1"}
+	got := make(map[string]string)
+	err = db.Iterate(func(key string, value []byte) error {
+		if _, ok := got[key]; ok {
+			t.Errorf("Iterate() key %q was visited twice", key)
+		}
+		got[key] = string(value)
+		// Concurrent writes must not block or affect the iteration.
+		return db.Set("e", []byte("1"))
+	})
+	if err != nil {
+		t.Fatalf("Iterate() error %v", err)
+	}
+	if len(got) != len(want) {
+		t.Errorf("Iterate() got %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("Iterate() key %q = %q, want %q", k, got[k], v)
+		}
+	}
+
+	want["e"] = "1"
+	clear(got)
+	for key, value := range db.All() {
+		got[key] = string(value)
+	}
+	if len(got) != len(want) {
+		t.Errorf("All() got %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("All() key %q = %q, want %q", k, got[k], v)
+		}
+	}
+
+	var n int
+	for range db.All() {
+		n++
+		break
+	}
+	if n != 1 {
+		t.Errorf("All() break after %d keys, want 1", n)
+	}
+
+	errStop := errors.New("stop")
+	err = db.Iterate(func(key string, value []byte) error {
+		return errStop
+	})
+	if err != errStop {
+		t.Errorf("Iterate() error %v, want %v", err, errStop)
+	}
+
+	teardown()
+}
@@ -0,0 +1,46 @@
+package rascaldb
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// lockName is a lock file in the db dir. A process which opened the database holds a lock of the file,
+// so other processes can't open the same database and corrupt each other's segments.
+const lockName = "LOCK"
+
+// lockDir locks the db dir: exclusively if db is writable, and shared if db is read-only,
+// so several readers can coexist without writers.
+// ErrLocked is returned when the lock is held by another process.
+// Read-only db doesn't create the lock file, so it can't be opened if the file doesn't exist,
+// i.e., the database was never opened for writes by a version which locks the db dir.
+// Otherwise a writer could compact and delete segments under the reader.
+func lockDir(dir string, readOnly bool, perm os.FileMode) (*os.File, error) {
+	path := filepath.Join(dir, lockName)
+	var (
+		f   *os.File
+		err error
+	)
+	if readOnly {
+		f, err = os.Open(path)
+	} else {
+		f, err = os.OpenFile(path, os.O_CREATE|os.O_RDONLY, perm)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err = lockFile(f, !readOnly); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// unlockDir releases the lock of the db dir by closing the lock file.
+func unlockDir(f *os.File) error {
+	if f == nil {
+		return nil
+	}
+	return f.Close()
+}
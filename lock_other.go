@@ -0,0 +1,11 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package rascaldb
+
+import "os"
+
+// lockFile is a no-op on platforms without flock, so the database is not protected
+// from being opened by several processes.
+func lockFile(f *os.File, exclusive bool) error {
+	return nil
+}
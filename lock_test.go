@@ -0,0 +1,43 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package rascaldb
+
+import "testing"
+
+func TestOpen_locked(t *testing.T) {
+	dbpath := "testdata/lock.db"
+	readOnly := &Options{ReadOnly: true}
+	db, err := Open(dbpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Open(dbpath); err != ErrLocked {
+		t.Errorf("Open() of opened db error %v, want %v", err, ErrLocked)
+	}
+	if _, err = OpenWithOptions(dbpath, readOnly); err != ErrLocked {
+		t.Errorf("OpenWithOptions() read-only of opened db error %v, want %v", err, ErrLocked)
+	}
+	db.Close()
+
+	// Several readers can open the database, but not a writer.
+	r1, err := OpenWithOptions(dbpath, readOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, err := OpenWithOptions(dbpath, readOnly)
+	if err != nil {
+		t.Fatalf("OpenWithOptions() read-only twice error %v", err)
+	}
+	if _, err = Open(dbpath); err != ErrLocked {
+		t.Errorf("Open() of db opened by readers error %v, want %v", err, ErrLocked)
+	}
+	r1.Close()
+	r2.Close()
+
+	if db, err = Open(dbpath); err != nil {
+		t.Fatalf("Open() after Close error %v", err)
+	}
+	db.Close()
+
+	teardown()
+}
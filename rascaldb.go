@@ -2,127 +2,645 @@
 package rascaldb
 
 import (
+	"context"
+	"errors"
 	"os"
 	"path/filepath"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
+const (
+	// DefaultMaxSegmentSize is a default size of a segment file (64 MB)
+	// after which the segment is sealed and a new one is created.
+	DefaultMaxSegmentSize = 64 << 20
+	// DefaultFileMode is a default permission of database files.
+	DefaultFileMode os.FileMode = 0600
+	// DefaultDirMode is a default permission of database dir.
+	DefaultDirMode os.FileMode = 0700
+	// DefaultSyncPeriod is a default interval of flushing writes to disk with SyncPeriodic policy.
+	DefaultSyncPeriod = time.Second
+
+	// maxSegmentNameAttempts is a number of names to try when a new segment file is created
+	// before giving up because the names are already taken.
+	maxSegmentNameAttempts = 1000
+)
+
+// SyncPolicy defines when writes are flushed to disk (fsync).
+type SyncPolicy int
+
+const (
+	// SyncAlways flushes every write to disk before the write returns. It is the default policy.
+	SyncAlways SyncPolicy = iota
+	// SyncPeriodic flushes writes to disk in background every Options.SyncPeriod,
+	// so the writes made since the last flush could be lost if the machine crashed.
+	SyncPeriodic
+	// SyncNever leaves flushing to the operating system.
+	// Writes are flushed only by DB.Sync, segment rotation, and Close.
+	SyncNever
+)
+
+// Options configures a database, see OpenWithOptions.
+// Zero value of a field means a default is used.
+type Options struct {
+	// MaxSegmentSize is a size of a segment file in bytes. When the current segment reaches the size,
+	// it is sealed (becomes read-only) and new records are appended to a new segment.
+	MaxSegmentSize int64
+	// OrderedIndex enables an ordered index of keys which is maintained along with the hash map index.
+	// It makes Scan, ReverseScan, and ScanPrefix efficient at the cost of memory and slower writes.
+	OrderedIndex bool
+	// FileMode is a permission of segment, hint, and trunk files created by database.
+	FileMode os.FileMode
+	// DirMode is a permission of database dir if it doesn't exist.
+	DirMode os.FileMode
+	// SegmentNamer returns unique filenames of new segments, by default random names are generated.
+	// It must be safe for concurrent use, since segments are created by writes and compaction.
+	// Names of existing files are skipped, so the namer may repeat names across reopens, e.g., a counter.
+	SegmentNamer func() string
+	// ReadOnly opens an existing database only for reads, no files are created or modified.
+	// Writes return ErrReadOnly. Several processes can open a database in read-only mode at the same time.
+	// The database must have been opened for writes at least once, because the lock file is not created
+	// in read-only mode, and without it the database can't be protected from writers.
+	ReadOnly bool
+	// SyncPolicy defines when writes are flushed to disk, by default every write is flushed.
+	SyncPolicy SyncPolicy
+	// SyncPeriod is an interval of flushing writes to disk with SyncPeriodic policy.
+	SyncPeriod time.Duration
+	// CacheSize is a max total size in bytes of keys and values kept in LRU cache,
+	// so hot keys are read without disk access. Zero size disables the cache.
+	CacheSize int64
+}
+
 // DB represents RascalDB database on disk, created by Open.
 type DB struct {
 	// name is a dir where segment files are stored.
 	name string
+	// maxSegmentSize is a size of a segment file after which the segments are rotated.
+	maxSegmentSize int64
+	// orderedIndex indicates that segments maintain ordered indexes of keys.
+	orderedIndex bool
+	// fileMode is a permission of files created by database.
+	fileMode os.FileMode
+	// readOnly indicates that database can't be modified.
+	readOnly bool
+	// lock is the lock file which prevents other processes from opening the database.
+	lock *os.File
+	// cache keeps values of recently read keys. It is nil if the cache is disabled.
+	cache *cache
+	// syncPolicy defines when writes are flushed to disk.
+	syncPolicy SyncPolicy
+	// syncPeriod is an interval of flushing writes to disk by the actor with SyncPeriodic policy.
+	syncPeriod time.Duration
 	// segmentNamer is a function that returns random segment names.
 	segmentNamer func() string
-	// mu mutex is used only to modify segments slice.
+	// mu mutex is used only to modify segments slice and segments' snapshot references.
 	mu sync.Mutex
+	// compactMu makes sure only one compaction runs at a time.
+	compactMu sync.Mutex
 	// segments is a slice of segment files where records are stored.
 	// Oldest segments are in the beginning of the slice.
 	segments atomic.Value
+	// retired are the segments replaced by compaction or merge which are kept until snapshots are released.
+	retired map[*segment]struct{}
 
 	// DB is a state machine which requires various concurrent actions, for example,
 	// put new keys, rotate segments when the current one becomes too big.
 	// Actions are executed in run method which acts as a serialization point;
 	// have a look at Actor stuff https://speakerdeck.com/peterbourgon/ways-to-do-things.
 	actionsc chan func()
+	// writesc receives writes which the actor groups together to flush them to disk with a single fsync.
+	writesc chan *writeRequest
+	// onWriteGroup is called by the actor with a number of writes flushed together. It is set only by tests.
+	onWriteGroup func(n int)
 	// quitc signals the actor to stop.
 	quitc chan struct{}
+	// donec is closed when the actor has stopped.
+	donec chan struct{}
+	// closed is set by Close.
+	closed atomic.Bool
 }
 
 // Open opens a database with the specified name.
 // If a database doesn't exist, it will be created. Database is a dir where segment files are kept.
+// ErrLocked is returned if the database is already opened by another process.
 func Open(name string) (*DB, error) {
+	return OpenWithOptions(name, nil)
+}
+
+// OpenWithOptions opens a database with the specified name and options.
+// Nil options are the same as Open with defaults.
+func OpenWithOptions(name string, opt *Options) (*DB, error) {
+	if opt == nil {
+		opt = &Options{}
+	}
 	db := DB{
-		name:         name,
-		segmentNamer: newSegmentNamer(),
-		actionsc:     make(chan func()),
-		quitc:        make(chan struct{}),
+		name:           name,
+		maxSegmentSize: opt.MaxSegmentSize,
+		orderedIndex:   opt.OrderedIndex,
+		fileMode:       opt.FileMode,
+		readOnly:       opt.ReadOnly,
+		syncPolicy:     opt.SyncPolicy,
+		syncPeriod:     opt.SyncPeriod,
+		segmentNamer:   opt.SegmentNamer,
+		retired:        make(map[*segment]struct{}),
+		actionsc:       make(chan func()),
+		writesc:        make(chan *writeRequest),
+		quitc:          make(chan struct{}),
+		donec:          make(chan struct{}),
+	}
+	if db.maxSegmentSize <= 0 {
+		db.maxSegmentSize = DefaultMaxSegmentSize
+	}
+	if db.fileMode == 0 {
+		db.fileMode = DefaultFileMode
+	}
+	if db.segmentNamer == nil {
+		db.segmentNamer = newSegmentNamer()
+	}
+	if db.syncPeriod <= 0 {
+		db.syncPeriod = DefaultSyncPeriod
+	}
+	if opt.CacheSize > 0 {
+		db.cache = newCache(opt.CacheSize)
+	}
+	dirMode := opt.DirMode
+	if dirMode == 0 {
+		dirMode = DefaultDirMode
+	}
+	if !db.readOnly {
+		if err := os.MkdirAll(db.name, dirMode); err != nil {
+			return nil, err
+		}
+	}
+
+	// Other processes can't open the database until it is closed.
+	lock, err := lockDir(db.name, db.readOnly, db.fileMode)
+	if err != nil {
+		return nil, err
 	}
-	if err := os.MkdirAll(db.name, 0700); err != nil {
+	db.lock = lock
+	if err = db.loadSegments(); err != nil {
+		unlockDir(db.lock)
 		return nil, err
 	}
 
+	go db.run()
+	return &db, nil
+}
+
+// loadSegments opens segments listed in the trunk and loads their indexes.
+// If the trunk doesn't exist, a new database is created unless it is read-only.
+func (db *DB) loadSegments() error {
 	path := filepath.Join(db.name, trunk)
 	filenames, err := readSegmentNames(path)
 	// Since there is no trunk file, this is a new database.
 	// Let's create the first segment and store its name in the trunk.
-	if os.IsNotExist(err) {
-		filenames = append(filenames, db.segmentNamer())
-		err = writeSegmentNames(path, filenames)
+	if os.IsNotExist(err) && !db.readOnly {
+		var s *segment
+		if s, err = db.createSegment(); err == nil {
+			s.close()
+			filenames = append(filenames, filepath.Base(s.name))
+			err = writeSegmentNames(path, filenames, db.fileMode)
+		}
 	}
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	ss := make([]*segment, 0, len(filenames))
 	var s *segment
-	// Open segments for reads, load indexes. The last segment is opened for writes.
+	// Open segments for reads, load indexes. The last segment is opened for writes unless db is read-only.
+	// Indexes of sealed segments are loaded from hint files when possible.
 	for i, segName := range filenames {
 		isLast := i == len(filenames)-1
-		path = filepath.Join(db.name, segName)
-		if s, err = openSegment(path, isLast); err != nil {
-			return nil, err
+		if s, err = db.openSegment(segName, isLast && !db.readOnly); err != nil {
+			s.close()
+			closeSegments(ss)
+			return err
 		}
-		if err = s.loadIndex(); err != nil {
-			return nil, err
+		var end int64
+		if isLast {
+			end, err = s.loadIndex()
+		} else if end, err = s.loadHint(); err != nil {
+			end, err = s.loadIndex()
+		}
+		// The current segment could have a partially written record at the end when db crashed,
+		// so the segment is truncated back to the last valid record.
+		// Read-only db ignores the partial record instead.
+		if isLast && err == ErrCorrupted {
+			if db.readOnly {
+				err = nil
+			} else {
+				err = s.truncate(end)
+			}
+		}
+		if err != nil {
+			s.close()
+			closeSegments(ss)
+			return err
 		}
+		// New records are appended to the end of file (O_APPEND),
+		// so the offset must match it to index the records correctly.
+		s.offset = end
 		ss = append(ss, s)
 	}
 	db.segments.Store(ss)
+	return nil
+}
 
-	go db.run()
-	return &db, nil
+// closeSegments closes the segment files.
+func closeSegments(ss []*segment) {
+	for _, s := range ss {
+		s.close()
+	}
 }
 
-// Close closes database resources.
-func (db *DB) Close() {
+// Close closes database resources. Writes which are in progress or waiting for the actor
+// are finished before the segment files are flushed and closed, so is a running compaction or merge.
+// Operations called after Close return ErrClosed, so does Close itself.
+func (db *DB) Close() error {
+	// The compaction needs the actor to replace segments, so it is waited for before db is marked closed.
+	// Meanwhile, reads and writes are served as usual.
+	// Compactions started later see that db is closed once they acquire the lock.
+	db.compactMu.Lock()
+	defer db.compactMu.Unlock()
+	if db.closed.Swap(true) {
+		return ErrClosed
+	}
 	// The state machine's loop is stopped.
 	close(db.quitc)
+	<-db.donec
+
+	var errs []error
 	// All segment files are closed.
-	ss := db.segments.Load().([]*segment)
-	for _, s := range ss {
-		s.close()
+	for _, s := range db.segments.Load().([]*segment) {
+		if err := s.close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	// Segments kept for snapshots are no longer needed since they are not in the trunk.
+	db.mu.Lock()
+	for s := range db.retired {
+		if err := s.remove(); err != nil {
+			errs = append(errs, err)
+		}
+		s.retired = false
 	}
+	clear(db.retired)
+	db.mu.Unlock()
+	// Other processes can open the database now.
+	if err := unlockDir(db.lock); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
 }
 
 // run executes every function from actionsc and acts as a serialization point.
 // It doesn't know about business logic.
+// With SyncPeriodic policy it also flushes writes to disk periodically.
 func (db *DB) run() {
+	defer close(db.donec)
+
+	var tickc <-chan time.Time
+	if db.syncPolicy == SyncPeriodic && !db.readOnly {
+		t := time.NewTicker(db.syncPeriod)
+		defer t.Stop()
+		tickc = t.C
+	}
+
 	for {
 		select {
 		case f := <-db.actionsc:
 			f()
+		case w := <-db.writesc:
+			db.writeGroup(w)
+		case <-tickc:
+			// The writes stay unflushed if fsync failed, so they are flushed on the next tick or by Sync.
+			db.sync()
 		case <-db.quitc:
+			db.drain()
+			return
+		}
+	}
+}
+
+// drain executes actions and writes which are already waiting for the actor when db is being closed,
+// so their callers are not left without a result.
+func (db *DB) drain() {
+	for {
+		select {
+		case f := <-db.actionsc:
+			f()
+		case w := <-db.writesc:
+			db.writeGroup(w)
+		default:
+			return
+		}
+	}
+}
+
+// do executes f in the actor and waits for its result.
+// It stops waiting and returns ctx.Err() when the context is done.
+// Note, f could have been executed anyway if the context was canceled while f was running.
+func (db *DB) do(ctx context.Context, f func() error) error {
+	if db.closed.Load() {
+		return ErrClosed
+	}
+	// errc is buffered, so the actor doesn't block when the caller stopped waiting.
+	errc := make(chan error, 1)
+	action := func() {
+		// The caller has given up, so there is no need to execute f.
+		if err := ctx.Err(); err != nil {
+			errc <- err
 			return
 		}
+		errc <- f()
+	}
+
+	select {
+	case db.actionsc <- action:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-db.quitc:
+		return ErrClosed
+	}
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// rotate seals the current segment and creates a new one where next records will be appended.
+// The current segment is flushed to disk before the trunk lists the new segment,
+// because only the last segment in the trunk is truncated back to its last valid record when db is opened.
+// The new segment is stored in the trunk before it becomes visible to readers.
+// Note, it must be called only from the actor.
+func (db *DB) rotate() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	ss := db.segments.Load().([]*segment)
+	sealed := ss[len(ss)-1]
+	if err := sealed.flush(); err != nil {
+		return err
+	}
+
+	s, err := db.createSegment()
+	if err != nil {
+		return err
+	}
+
+	next := make([]*segment, len(ss), len(ss)+1)
+	copy(next, ss)
+	next = append(next, s)
+	if err = writeSegmentNames(filepath.Join(db.name, trunk), segmentNames(next), db.fileMode); err != nil {
+		s.remove()
+		return err
+	}
+	// The hint is accounted before the sealed segment can be picked up by compaction which closes it.
+	sealed.hinting.Add(1)
+	db.segments.Store(next)
+
+	// The sealed segment stays open for reads.
+	if err = sealed.seal(); err != nil {
+		sealed.hinting.Done()
+		return err
+	}
+	// The sealed segment's index doesn't change anymore, so the hint is written outside of the actor.
+	// The hint is optional since the index can be loaded from the segment itself,
+	// so the new segment is used even if the hint couldn't be written.
+	go func() {
+		defer sealed.hinting.Done()
+		if err := sealed.writeHint(); err != nil {
+			os.Remove(hintName(sealed.name))
+		}
+	}()
+	return nil
+}
+
+// createSegment creates a new segment file in the db dir named by the segment namer.
+// The file must not exist, otherwise records would be appended to a segment which could be in use,
+// e.g., when the namer returns the same names after db is reopened. Such names are skipped.
+func (db *DB) createSegment() (*segment, error) {
+	for i := 1; ; i++ {
+		name := db.segmentNamer()
+		f, err := os.OpenFile(filepath.Join(db.name, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, db.fileMode)
+		if os.IsExist(err) && i < maxSegmentNameAttempts {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		f.Close()
+
+		s, err := db.openSegment(name, true)
+		if err != nil {
+			s.remove()
+			return nil, err
+		}
+		return s, nil
+	}
+}
+
+// openSegment opens a segment file in the db dir, see openSegment.
+// The segment maintains an ordered index if the database was opened with one.
+func (db *DB) openSegment(name string, writable bool) (*segment, error) {
+	s, err := openSegment(filepath.Join(db.name, name), writable, db.fileMode)
+	s.lazySync = db.syncPolicy != SyncAlways
+	if db.orderedIndex {
+		s.keys = newSkiplist()
 	}
+	return s, err
+}
+
+// Sync flushes writes to disk. It is a durability point for databases opened
+// with SyncPeriodic or SyncNever policy, i.e., the writes made before Sync survive a crash.
+func (db *DB) Sync() error {
+	return db.SyncContext(context.Background())
+}
+
+// SyncContext is like Sync, but it returns ctx.Err() when the context is done before the writes are flushed.
+// Note, the writes could have been flushed anyway if the context was canceled during the flush.
+func (db *DB) SyncContext(ctx context.Context) error {
+	return db.do(ctx, db.sync)
+}
+
+// sync flushes writes of the current segment to disk. Sealed segments are flushed when they are sealed.
+// Note, it must be called only from the actor.
+func (db *DB) sync() error {
+	ss := db.segments.Load().([]*segment)
+	return ss[len(ss)-1].sync()
+}
+
+// segmentNames returns filenames of segments (without db dir) to be stored in the trunk.
+func segmentNames(ss []*segment) []string {
+	names := make([]string, len(ss))
+	for i, s := range ss {
+		names[i] = filepath.Base(s.name)
+	}
+	return names
+}
+
+// current returns the segment where new records should be appended.
+// When the current segment is full, segments are rotated.
+// Segments without a header written by older versions are rotated as well,
+// so new records are never appended after records which have no checksum.
+// So is the segment which has a partially written record left after a failed write.
+// ErrReadOnly is returned if db was opened in read-only mode.
+// Note, it must be called only from the actor.
+func (db *DB) current() (*segment, error) {
+	if db.readOnly {
+		return nil, ErrReadOnly
+	}
+	ss := db.segments.Load().([]*segment)
+	if s := ss[len(ss)-1]; s.version != 0 && !s.failed && s.offset < db.maxSegmentSize {
+		return s, nil
+	}
+
+	if err := db.rotate(); err != nil {
+		return nil, err
+	}
+	ss = db.segments.Load().([]*segment)
+	return ss[len(ss)-1], nil
 }
 
 // Set puts a key in database. You can call it concurrently.
+// Concurrent writes are grouped together and flushed to disk with a single fsync.
 func (db *DB) Set(key string, value []byte) error {
-	errc := make(chan error)
+	return db.SetContext(context.Background(), key, value)
+}
 
-	db.actionsc <- func() {
-		ss := db.segments.Load().([]*segment)
-		current := ss[len(ss)-1]
-		errc <- current.write(key, value)
-	}
+// SetContext is like Set, but it returns ctx.Err() when the context is done before the key is written.
+// Note, the key could have been written anyway if the context was canceled during the write.
+func (db *DB) SetContext(ctx context.Context, key string, value []byte) error {
+	return db.write(ctx, &Batch{ops: []batchOp{{key: key, value: value}}})
+}
+
+// SetWithTTL puts a key in database which expires after the ttl. You can call it concurrently.
+// Expired keys are not found by Get and they are dropped by compaction.
+func (db *DB) SetWithTTL(key string, value []byte, ttl time.Duration) error {
+	return db.SetWithTTLContext(context.Background(), key, value, ttl)
+}
 
-	return <-errc
+// SetWithTTLContext is like SetWithTTL, but it returns ctx.Err() when the context is done before the key is written.
+func (db *DB) SetWithTTLContext(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	expires := time.Now().Add(ttl).UnixNano()
+	return db.write(ctx, &Batch{ops: []batchOp{{key: key, value: value, expires: expires}}})
+}
+
+// Delete removes a key from database. You can call it concurrently.
+// A tombstone record is appended to make sure the key is not found in older segments.
+// Deleting a key which doesn't exist is not an error.
+func (db *DB) Delete(key string) error {
+	return db.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext is like Delete, but it returns ctx.Err() when the context is done before the key is deleted.
+func (db *DB) DeleteContext(ctx context.Context, key string) error {
+	return db.write(ctx, &Batch{ops: []batchOp{{key: key, deleted: true}}})
+}
+
+// SetBytes is like Set, but the key is a byte slice.
+// Keys can contain arbitrary bytes including zeros.
+func (db *DB) SetBytes(key, value []byte) error {
+	return db.Set(string(key), value)
+}
+
+// DeleteBytes is like Delete, but the key is a byte slice.
+func (db *DB) DeleteBytes(key []byte) error {
+	return db.Delete(string(key))
+}
+
+// GetBytes is like Get, but the key is a byte slice.
+func (db *DB) GetBytes(key []byte) ([]byte, error) {
+	return db.Get(string(key))
 }
 
 // Get retrieves a key from database. You can call it concurrently.
+// ErrKeyNotFound is returned when the key doesn't exist, was deleted, or has expired.
 func (db *DB) Get(key string) ([]byte, error) {
-	ss := db.segments.Load().([]*segment)
+	return db.GetContext(context.Background(), key)
+}
+
+// GetContext is like Get, but it returns ctx.Err() if the context is done before the key is read.
+func (db *DB) GetContext(ctx context.Context, key string) ([]byte, error) {
+	value, _, err := db.get(ctx, key)
+	return value, err
+}
 
-	var ok bool
-	var offset int64
+// get retrieves a key from database along with the location of its record.
+// The context is checked before every lookup, since the key is looked up again
+// when its segment was replaced by compaction during the read.
+func (db *DB) get(ctx context.Context, key string) ([]byte, location, error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, location{}, err
+		}
+		if db.closed.Load() {
+			return nil, location{}, ErrClosed
+		}
+		ss := db.segments.Load().([]*segment)
+		loc := locate(ss, key)
+		// Not found and deleted keys are never read from disk, so they are not cache misses.
+		if loc.s != nil && !loc.e.deleted {
+			if value, ok := db.cache.get(key, loc); ok {
+				return value, loc, nil
+			}
+		}
+		value, err := loc.read()
+		// A segment could have been closed after compaction replaced it,
+		// so the key must be looked up again in the latest segments.
+		// The segment could also have been closed by Close which is checked above.
+		if errors.Is(err, os.ErrClosed) && (db.closed.Load() || !sameSegments(ss, db.segments.Load().([]*segment))) {
+			continue
+		}
+		if err == nil {
+			db.cache.add(key, loc, value)
+		}
+		return value, loc, err
+	}
+}
+
+// sameSegments reports whether both slices have the same segments.
+func sameSegments(ss1, ss2 []*segment) bool {
+	if len(ss1) != len(ss2) {
+		return false
+	}
+	for i := range ss1 {
+		if ss1[i] != ss2[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// location is where the latest record of a key is stored.
+// Zero location means the key was not found.
+type location struct {
+	s *segment
+	e entry
+}
+
+// locate looks up a key in segments starting from the newest one.
+// The lookup stops at the first segment which has the key, even if it is a tombstone.
+func locate(ss []*segment, key string) location {
 	for i := len(ss) - 1; i >= 0; i-- {
-		if offset, ok = ss[i].index[key]; ok {
-			_, value, err := ss[i].read(offset)
-			return value, err
+		if e, ok := ss[i].lookup(key); ok {
+			return location{s: ss[i], e: e}
 		}
 	}
+	return location{}
+}
 
-	return nil, ErrKeyNotFound
+// read reads a value of the located record.
+// ErrKeyNotFound is returned when the key was not found, it was deleted, or it has expired.
+func (loc location) read() ([]byte, error) {
+	if loc.s == nil || loc.e.deleted || loc.e.expired(time.Now().UnixNano()) {
+		return nil, ErrKeyNotFound
+	}
+	_, value, err := loc.s.read(loc.e.offset)
+	return value, err
 }
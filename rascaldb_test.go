@@ -2,8 +2,11 @@ package rascaldb
 
 import (
 	"bytes"
+	"fmt"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 // Make sure testdata is cleared after the tests run.
@@ -18,6 +21,32 @@ func teardown() {
 	os.Remove("testdata/writesegment")
 	os.Remove("testdata/writetrunk.txt")
 	os.RemoveAll("testdata/new.db")
+	os.RemoveAll("testdata/rotate.db")
+	os.RemoveAll("testdata/compact.db")
+	os.RemoveAll("testdata/delete.db")
+	os.RemoveAll("testdata/torn.db")
+	os.RemoveAll("testdata/reopen.db")
+	os.RemoveAll("testdata/binary.db")
+	os.RemoveAll("testdata/hint.db")
+	os.RemoveAll("testdata/batch.db")
+	os.RemoveAll("testdata/tx.db")
+	os.RemoveAll("testdata/snapshot.db")
+	os.RemoveAll("testdata/iterate.db")
+	os.RemoveAll("testdata/scan.db")
+	os.RemoveAll("testdata/ttl.db")
+	os.RemoveAll("testdata/cas.db")
+	os.RemoveAll("testdata/context.db")
+	os.RemoveAll("testdata/options.db")
+	os.RemoveAll("testdata/group.db")
+	os.RemoveAll("testdata/sync.db")
+	os.RemoveAll("testdata/lock.db")
+	os.RemoveAll("testdata/close.db")
+	os.RemoveAll("testdata/concurrent.db")
+	os.RemoveAll("testdata/cache.db")
+	os.RemoveAll("testdata/compat.db")
+	os.RemoveAll("testdata/writeerr.db")
+	os.Remove("testdata/read.db/LOCK")
+	os.Remove("testdata/writesegment.hint")
 }
 
 func equal(s1, s2 []string) bool {
@@ -57,6 +86,141 @@ func TestOpen_new(t *testing.T) {
 	}
 }
 
+func TestOpenWithOptions(t *testing.T) {
+	dbpath := "testdata/options.db"
+	var n int
+	opt := Options{
+		FileMode: 0640,
+		DirMode:  0750,
+		SegmentNamer: func() string {
+			n++
+			return fmt.Sprintf("segment%d", n)
+		},
+	}
+	db, err := OpenWithOptions(dbpath, &opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	want := map[string]os.FileMode{
+		dbpath:                            os.ModeDir | 0750,
+		filepath.Join(dbpath, trunk):      0640,
+		filepath.Join(dbpath, "segment1"): 0640,
+	}
+	for path, mode := range want {
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Errorf("OpenWithOptions() file %q: %v", path, err)
+			continue
+		}
+		if fi.Mode() != mode {
+			t.Errorf("OpenWithOptions() file %q mode %v, want %v", path, fi.Mode(), mode)
+		}
+	}
+
+	teardown()
+}
+
+func TestOpenWithOptions_segmentNamer(t *testing.T) {
+	dbpath := "testdata/options.db"
+	defer teardown()
+	// The namer starts over after reopen, so it repeats names of existing segments.
+	open := func() *DB {
+		t.Helper()
+		var n int
+		// Segment header is 16 bytes and a record is 15 bytes long, so every write after the first one rotates segments.
+		db, err := OpenWithOptions(dbpath, &Options{
+			MaxSegmentSize: 31,
+			SegmentNamer: func() string {
+				n++
+				return fmt.Sprintf("segment%d", n)
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+
+	db := open()
+	for _, key := range []string{"a", "b"} {
+		if err := db.Set(key, []byte("1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	db = open()
+	defer db.Close()
+	for _, key := range []string{"c", "d"} {
+		if err := db.Set(key, []byte("1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	names, err := readSegmentNames(filepath.Join(dbpath, trunk))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"segment1", "segment2", "segment3", "segment4"}; !equal(names, want) {
+		t.Errorf("Set() trunk %q, want %q", names, want)
+	}
+	for _, key := range []string{"a", "b", "c", "d"} {
+		if _, err = db.Get(key); err != nil {
+			t.Errorf("Get(%q) error %v", key, err)
+		}
+	}
+}
+
+func TestOpenWithOptions_readOnly(t *testing.T) {
+	dbpath := "testdata/options.db"
+	if _, err := OpenWithOptions(dbpath, &Options{ReadOnly: true}); !os.IsNotExist(err) {
+		t.Errorf("OpenWithOptions() of missing db error %v, want not exist", err)
+	}
+	if _, err := os.Stat(dbpath); !os.IsNotExist(err) {
+		t.Errorf("OpenWithOptions() created db dir in read-only mode")
+	}
+
+	db, err := Open(dbpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Set("a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	if db, err = OpenWithOptions(dbpath, &Options{ReadOnly: true}); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := db.Get("a"); err != nil || !bytes.Equal(got, []byte("1")) {
+		t.Errorf("Get(%q) = %q, %v, want %q", "a", got, err, "1")
+	}
+	if err = db.Set("a", []byte("2")); err != ErrReadOnly {
+		t.Errorf("Set() error %v, want %v", err, ErrReadOnly)
+	}
+	if err = db.Delete("a"); err != ErrReadOnly {
+		t.Errorf("Delete() error %v, want %v", err, ErrReadOnly)
+	}
+	if err = db.Compact(); err != ErrReadOnly {
+		t.Errorf("Compact() error %v, want %v", err, ErrReadOnly)
+	}
+	if ss := db.segments.Load().([]*segment); ss[len(ss)-1].fw != nil {
+		t.Errorf("OpenWithOptions() opened the current segment for writes in read-only mode")
+	}
+	db.Close()
+
+	// The database can't be locked without the lock file.
+	if err = os.Remove(filepath.Join(dbpath, lockName)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = OpenWithOptions(dbpath, &Options{ReadOnly: true}); !os.IsNotExist(err) {
+		t.Errorf("OpenWithOptions() of db without lock file error %v, want not exist", err)
+	}
+
+	teardown()
+}
+
 func TestOpen_existing(t *testing.T) {
 	dbpath := "testdata/read.db"
 	db, err := Open(dbpath)
@@ -90,6 +254,186 @@ func TestOpen_existing(t *testing.T) {
 	if _, ok := segments[1].index["nick"]; !ok {
 		t.Errorf("Open(%q) second segment %q index is not loaded", dbpath, segments[1].name)
 	}
+
+	// The segment was written by an older version, its trailing newline is not a record.
+	if wantOffset := int64(36); segments[1].offset != wantOffset {
+		t.Errorf("Open(%q) current segment offset %d, want %d", dbpath, segments[1].offset, wantOffset)
+	}
+}
+
+func TestOpen_compatible(t *testing.T) {
+	// The database was written by an older version which had neither segment headers nor checksums.
+	dbpath := "testdata/compat.db"
+	if err := os.MkdirAll(dbpath, 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"trunk.txt", "oldsegment", "newsegment"} {
+		b, err := os.ReadFile(filepath.Join("testdata/read.db", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = os.WriteFile(filepath.Join(dbpath, name), b, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer teardown()
+
+	db, err := Open(dbpath)
+	if err != nil {
+		t.Fatalf("Open(%q) error %v", dbpath, err)
+	}
+	if err = db.Set("name", []byte("Tom")); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Delete("nick"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// New records are not appended to the old segment, a new segment is started instead.
+	b, err := os.ReadFile(filepath.Join(dbpath, "newsegment"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, _ := os.ReadFile("testdata/read.db/newsegment"); !bytes.Equal(b, want) {
+		t.Errorf("Set() modified the old segment: %q, want %q", b, want)
+	}
+
+	if db, err = Open(dbpath); err != nil {
+		t.Fatalf("Open(%q) error %v", dbpath, err)
+	}
+	defer db.Close()
+	if ss := db.segments.Load().([]*segment); len(ss) != 3 {
+		t.Errorf("Open(%q) got segments %d, want 3", dbpath, len(ss))
+	}
+	if got, err := db.Get("name"); err != nil || !bytes.Equal(got, []byte("Tom")) {
+		t.Errorf("Get(%q) = %q, %v, want %q", "name", got, err, "Tom")
+	}
+	if _, err = db.Get("nick"); err != ErrKeyNotFound {
+		t.Errorf("Get(%q) error %v, want %v", "nick", err, ErrKeyNotFound)
+	}
+
+	// Old segments are compacted into segments of the current format.
+	if err = db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := db.Get("name"); err != nil || !bytes.Equal(got, []byte("Tom")) {
+		t.Errorf("Get(%q) after Compact() = %q, %v, want %q", "name", got, err, "Tom")
+	}
+}
+
+func TestOpen_reopen(t *testing.T) {
+	dbpath := "testdata/reopen.db"
+	db, err := Open(dbpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Set("name", []byte("Bob")); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// Records appended after reopening must be indexed at their actual offsets.
+	if db, err = Open(dbpath); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Set("nick", []byte("B0B")); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Set("name", []byte("Rob")); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"name": "Rob", "nick": "B0B"}
+	check := func() {
+		t.Helper()
+		for k, v := range want {
+			got, err := db.Get(k)
+			if err != nil {
+				t.Errorf("Get(%q) error %v", k, err)
+			}
+			if !bytes.Equal(got, []byte(v)) {
+				t.Errorf("Get(%q) = %q, want %q", k, got, v)
+			}
+		}
+	}
+	check()
+	db.Close()
+
+	if db, err = Open(dbpath); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check()
+
+	teardown()
+}
+
+func TestOpen_tornWrite(t *testing.T) {
+	dbpath := "testdata/torn.db"
+	db, err := Open(dbpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Set("name", []byte("Bob")); err != nil {
+		t.Fatal(err)
+	}
+	segments := db.segments.Load().([]*segment)
+	current := segments[len(segments)-1].name
+	db.Close()
+
+	// Simulate a crash when only a part of the record was written.
+	f, err := os.OpenFile(current, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	torn := encode("nick", []byte("B0B"))
+	if _, err = f.Write(torn[:len(torn)-1]); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if db, err = Open(dbpath); err != nil {
+		t.Fatalf("Open(%q) error %v", dbpath, err)
+	}
+	defer db.Close()
+
+	fi, err := os.Stat(current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the segment header (16 bytes) and name=Bob record (20 bytes) are left.
+	if wantSize := int64(36); fi.Size() != wantSize {
+		t.Errorf("Open(%q) segment size %d, want %d", dbpath, fi.Size(), wantSize)
+	}
+	if got, err := db.Get("name"); err != nil || !bytes.Equal(got, []byte("Bob")) {
+		t.Errorf("Get(%q) = %q, %v, want %q", "name", got, err, "Bob")
+	}
+	if _, err = db.Get("nick"); err != ErrKeyNotFound {
+		t.Errorf("Get(%q) error %v, want %v", "nick", err, ErrKeyNotFound)
+	}
+
+	teardown()
+}
+
+func TestOpen_emptyTrunk(t *testing.T) {
+	// Older versions rewrote the trunk in place, so a crash could leave it empty.
+	dbpath := "testdata/torn.db"
+	if err := os.MkdirAll(dbpath, 0700); err != nil {
+		t.Fatal(err)
+	}
+	defer teardown()
+	if err := os.WriteFile(filepath.Join(dbpath, trunk), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := Open(dbpath)
+	if err != ErrTrunkCorrupted {
+		t.Errorf("Open(%q) error %v, want %v", dbpath, err, ErrTrunkCorrupted)
+	}
+	if err == nil {
+		db.Close()
+	}
 }
 
 func TestDB_Get(t *testing.T) {
@@ -155,3 +499,245 @@ func TestDB_Set(t *testing.T) {
 		}
 	}
 }
+
+func TestDB_Set_rotate(t *testing.T) {
+	dbpath := "testdata/rotate.db"
+	// Segment header is 16 bytes and every record is 20 bytes long, so each segment fits two records.
+	db, err := OpenWithOptions(dbpath, &Options{MaxSegmentSize: 56})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []string{"k1", "k2", "k3", "k4", "k5"}
+	for _, k := range keys {
+		if err = db.Set(k, []byte("value")); err != nil {
+			t.Fatalf("Set(%q) error %v", k, err)
+		}
+	}
+
+	segments := db.segments.Load().([]*segment)
+	wantLen := 3
+	if len(segments) != wantLen {
+		t.Errorf("Set() got segments %d, want %d", len(segments), wantLen)
+	}
+	for _, s := range segments[:len(segments)-1] {
+		if s.fw != nil {
+			t.Errorf("Set() segment %q is not sealed", s.name)
+		}
+	}
+
+	names, err := readSegmentNames("testdata/rotate.db/trunk.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := segmentNames(segments); !equal(names, want) {
+		t.Errorf("Set() trunk %q, want %q", names, want)
+	}
+	db.Close()
+
+	// Keys are found in all segments after the db is reopened.
+	if db, err = Open(dbpath); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, k := range keys {
+		got, err := db.Get(k)
+		if err != nil {
+			t.Errorf("Get(%q) error %v", k, err)
+		}
+		if want := []byte("value"); !bytes.Equal(got, want) {
+			t.Errorf("Get(%q) = %q, want %q", k, got, want)
+		}
+	}
+
+	teardown()
+}
+
+func TestDB_Set_writeError(t *testing.T) {
+	dbpath := "testdata/writeerr.db"
+	db, err := Open(dbpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Set("name", []byte("Bob")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Writes fail since the segment file is opened only for reads.
+	s := db.segments.Load().([]*segment)[0]
+	fw := s.fw
+	if s.fw, err = os.Open(s.name); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Set("nick", []byte("B0B")); err == nil {
+		t.Fatalf("Set(%q) expected error", "nick")
+	}
+	if !s.failed {
+		t.Fatalf("Set(%q) didn't mark the segment as failed", "nick")
+	}
+	// Simulate a partially written record which couldn't be truncated.
+	s.fw.Close()
+	s.fw = fw
+	if _, err = fw.Write(encode("nick", []byte("B0B"))[:10]); err != nil {
+		t.Fatal(err)
+	}
+
+	// The failed segment is sealed without the partial record, and the next write goes to a new segment.
+	if err = db.Set("age", []byte("42")); err != nil {
+		t.Fatalf("Set(%q) error %v", "age", err)
+	}
+	if ss := db.segments.Load().([]*segment); len(ss) != 2 {
+		t.Errorf("Set() got segments %d, want 2", len(ss))
+	}
+	db.Close()
+
+	if db, err = Open(dbpath); err != nil {
+		t.Fatalf("Open(%q) error %v", dbpath, err)
+	}
+	defer db.Close()
+	for key, want := range map[string]string{"name": "Bob", "age": "42"} {
+		if got, err := db.Get(key); err != nil || !bytes.Equal(got, []byte(want)) {
+			t.Errorf("Get(%q) = %q, %v, want %q", key, got, err, want)
+		}
+	}
+	if _, err = db.Get("nick"); err != ErrKeyNotFound {
+		t.Errorf("Get(%q) error %v, want %v", "nick", err, ErrKeyNotFound)
+	}
+
+	teardown()
+}
+
+func TestDB_Delete(t *testing.T) {
+	dbpath := "testdata/delete.db"
+	// Segment header is 16 bytes and every record is 15 bytes long, so each segment fits two records.
+	db, err := OpenWithOptions(dbpath, &Options{MaxSegmentSize: 46})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, k := range []string{"a", "b"} {
+		if err = db.Set(k, []byte("1")); err != nil {
+			t.Fatalf("Set(%q) error %v", k, err)
+		}
+	}
+	// Tombstones are written to the next segment, so they shadow the keys in the older one.
+	for _, k := range []string{"a", "404"} {
+		if err = db.Delete(k); err != nil {
+			t.Errorf("Delete(%q) error %v", k, err)
+		}
+	}
+	if segments := db.segments.Load().([]*segment); len(segments) != 2 {
+		t.Errorf("Delete() got segments %d, want 2", len(segments))
+	}
+
+	check := func() {
+		t.Helper()
+		if got, err := db.Get("a"); err != ErrKeyNotFound {
+			t.Errorf("Get(%q) = %q, %v, want %v", "a", got, err, ErrKeyNotFound)
+		}
+		if got, err := db.Get("b"); err != nil || !bytes.Equal(got, []byte("1")) {
+			t.Errorf("Get(%q) = %q, %v, want %q", "b", got, err, "1")
+		}
+	}
+	check()
+	db.Close()
+
+	if db, err = Open(dbpath); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check()
+
+	teardown()
+}
+
+func TestDB_SetWithTTL(t *testing.T) {
+	dbpath := "testdata/ttl.db"
+	db, err := Open(dbpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.Set("a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.SetWithTTL("a", []byte("2"), -time.Second); err != nil {
+		t.Errorf("SetWithTTL(%q) error %v", "a", err)
+	}
+	if err = db.SetWithTTL("b", []byte("1"), time.Hour); err != nil {
+		t.Errorf("SetWithTTL(%q) error %v", "b", err)
+	}
+
+	check := func() {
+		t.Helper()
+		// The expired key doesn't fall back to the older record.
+		if got, err := db.Get("a"); err != ErrKeyNotFound {
+			t.Errorf("Get(%q) = %q, %v, want %v", "a", got, err, ErrKeyNotFound)
+		}
+		if got, err := db.Get("b"); err != nil || !bytes.Equal(got, []byte("1")) {
+			t.Errorf("Get(%q) = %q, %v, want %q", "b", got, err, "1")
+		}
+		var keys []string
+		for key := range db.All() {
+			keys = append(keys, key)
+		}
+		if len(keys) != 1 || keys[0] != "b" {
+			t.Errorf("All() keys %q, want [b]", keys)
+		}
+	}
+	check()
+	db.Close()
+
+	if db, err = Open(dbpath); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check()
+
+	teardown()
+}
+
+func TestDB_SetBytes(t *testing.T) {
+	dbpath := "testdata/binary.db"
+	db, err := Open(dbpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tt := []struct {
+		key   []byte
+		value []byte
+	}{
+		{[]byte{0}, []byte("zero")},
+		{[]byte{0, 0}, []byte("zero zero")},
+		{[]byte("a\x00b"), []byte("a zero b")},
+		{[]byte("a"), []byte("a")},
+		{[]byte{}, []byte("empty")},
+	}
+	for _, tc := range tt {
+		if err = db.SetBytes(tc.key, tc.value); err != nil {
+			t.Errorf("SetBytes(%q, %q) error %v", tc.key, tc.value, err)
+		}
+	}
+	if err = db.DeleteBytes([]byte("a\x00b")); err != nil {
+		t.Errorf("DeleteBytes(%q) error %v", "a\x00b", err)
+	}
+	tt[2].value = nil
+	db.Close()
+
+	if db, err = Open(dbpath); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, tc := range tt {
+		got, err := db.GetBytes(tc.key)
+		if tc.value == nil && err != ErrKeyNotFound {
+			t.Errorf("GetBytes(%q) error %v, want %v", tc.key, err, ErrKeyNotFound)
+		}
+		if !bytes.Equal(got, tc.value) {
+			t.Errorf("GetBytes(%q) = %q, want %q", tc.key, got, tc.value)
+		}
+	}
+
+	teardown()
+}
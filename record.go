@@ -0,0 +1,193 @@
+package rascaldb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+)
+
+// There are two record formats which can be mixed in a segment file:
+//
+//	v1: record length (4 bytes) | key | kvDelimeter | value
+//	v2: record length (4 bytes) | CRC-32 checksum (4 bytes) | flags (1 byte) | key length (4 bytes) |
+//	    [expiration time (8 bytes)] | key | value
+//
+// Expiration time in Unix nanoseconds is present only in v2 records with flagExpires set.
+// v1 records were written by older versions, they don't have a checksum and their keys can't contain kvDelimeter,
+// so new records are always written in v2 format.
+// v1 records are still decoded to be able to read segments written by older versions.
+// v2 records have recordV2 bit set in the record length, v1 records are found only in segments without a header.
+const (
+	// recordLenSize is a record length in bytes needed to encode uint32.
+	recordLenSize = 4
+	// checksumSize is a size of CRC-32 checksum of a record.
+	checksumSize = 4
+	// recordHeaderSize is a size of v2 record header: record length followed by the checksum.
+	recordHeaderSize = recordLenSize + checksumSize
+	// recordV2 is the highest bit of the record length which marks v2 records.
+	recordV2 = 1 << 31
+	// flagsSize is a size of v2 record flags.
+	flagsSize = 1
+	// keyLenSize is a size of v2 record key length.
+	keyLenSize = 4
+	// expiresSize is a size of v2 record expiration time.
+	expiresSize = 8
+	// maxRecordLen is a max length of v2 record, since the highest bit of the length marks v2 records.
+	maxRecordLen = recordV2 - 1
+)
+
+// kvDelimeter is a delimiter between key and value in v1 record.
+const kvDelimeter = byte('\x00')
+
+const (
+	// flagTombstone marks v2 record as a tombstone of a deleted key.
+	flagTombstone = 1 << 0
+	// flagBatch marks v2 record as a batch header. Its value is a number of records in the batch
+	// which follow the header. The records are indexed only if all of them were written.
+	flagBatch = 1 << 1
+	// flagExpires marks v2 record which has an expiration time, i.e., the key has a TTL.
+	flagExpires = 1 << 2
+)
+
+// record is a decoded key-value pair.
+type record struct {
+	key   string
+	value []byte
+	// deleted is set when the record is a tombstone.
+	deleted bool
+	// batch is a number of records in a batch if the record is a batch header.
+	batch int
+	// expires is an expiration time of the key in Unix nanoseconds, zero means the key doesn't expire.
+	expires int64
+}
+
+// encode prepares the key value pair to be stored in a file as v2 record.
+func encode(key string, value []byte) []byte {
+	return encodeRecord(0, key, 0, value)
+}
+
+// encodeExpiring prepares the key value pair which expires at the given time in Unix nanoseconds.
+// Zero expiration time means the key doesn't expire.
+func encodeExpiring(key string, value []byte, expires int64) []byte {
+	if expires == 0 {
+		return encode(key, value)
+	}
+	return encodeRecord(flagExpires, key, expires, value)
+}
+
+// encodeTombstone prepares a tombstone record which marks the key as deleted.
+// Tombstone has a flag set, so it can't be confused with an empty value.
+func encodeTombstone(key string) []byte {
+	return encodeRecord(flagTombstone, key, 0, nil)
+}
+
+// encodeBatchHeader prepares a header of a batch of n records.
+func encodeBatchHeader(n int) []byte {
+	return encodeRecord(flagBatch, "", 0, binary.LittleEndian.AppendUint32(nil, uint32(n)))
+}
+
+// encodeRecord encodes v2 record with the given flags.
+// The expiration time is encoded only if flagExpires is set.
+func encodeRecord(flags byte, key string, expires int64, value []byte) []byte {
+	blen := recordLen(flags, key, value)
+	b := make([]byte, recordHeaderSize, blen)
+
+	binary.LittleEndian.PutUint32(b, blen|recordV2)
+	b = append(b, flags)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(key)))
+	if flags&flagExpires != 0 {
+		b = binary.LittleEndian.AppendUint64(b, uint64(expires))
+	}
+	b = append(b, key...)
+	b = append(b, value...)
+	binary.LittleEndian.PutUint32(b[recordLenSize:], checksum(b))
+	return b
+}
+
+// checksum returns CRC-32 checksum of the encoded record b.
+// Record length and key-value are checksummed, i.e., everything except the checksum itself.
+func checksum(b []byte) uint32 {
+	crc := crc32.ChecksumIEEE(b[:recordLenSize])
+	return crc32.Update(crc, crc32.IEEETable, b[recordHeaderSize:])
+}
+
+// decode returns a record from encoded byte slice b which checksum (if any) was already verified.
+func decode(b []byte) (record, error) {
+	if binary.LittleEndian.Uint32(b)&recordV2 == 0 {
+		return decodeV1(b[recordLenSize:])
+	}
+	return decodeV2(b[recordHeaderSize:])
+}
+
+// decodeV1 returns a record from v1 key-value bytes b.
+// Older versions always wrote the delimiter, so a record without it is corrupted.
+func decodeV1(b []byte) (record, error) {
+	i := bytes.IndexByte(b, kvDelimeter)
+	if i == -1 {
+		return record{}, ErrCorrupted
+	}
+
+	return record{
+		key:   string(b[0:i]),
+		value: b[i+1:], // Skip delimeter and read till the end.
+	}, nil
+}
+
+// decodeV2 returns a record from v2 flags, key length, expiration time, and key-value bytes b.
+func decodeV2(b []byte) (record, error) {
+	if len(b) < flagsSize+keyLenSize {
+		return record{}, ErrCorrupted
+	}
+	flags := b[0]
+	klen := binary.LittleEndian.Uint32(b[flagsSize:])
+	b = b[flagsSize+keyLenSize:]
+
+	var expires int64
+	if flags&flagExpires != 0 {
+		if len(b) < expiresSize {
+			return record{}, ErrCorrupted
+		}
+		expires = int64(binary.LittleEndian.Uint64(b))
+		b = b[expiresSize:]
+	}
+	if uint64(klen) > uint64(len(b)) {
+		return record{}, ErrCorrupted
+	}
+
+	r := record{
+		key:     string(b[:klen]),
+		deleted: flags&flagTombstone != 0,
+		expires: expires,
+	}
+	switch {
+	case flags&flagBatch != 0:
+		b = b[klen:]
+		if len(b) != 4 {
+			return record{}, ErrCorrupted
+		}
+		r.batch = int(binary.LittleEndian.Uint32(b))
+	case !r.deleted:
+		r.value = b[klen:]
+	}
+	return r, nil
+}
+
+// checkRecordLen returns ErrTooLarge if the key and value don't fit into v2 record, see maxRecordLen.
+// Records must be checked before they are encoded, otherwise the record length would overflow.
+func checkRecordLen(key string, value []byte) error {
+	n := int64(recordHeaderSize+flagsSize+keyLenSize+expiresSize) + int64(len(key)) + int64(len(value))
+	if n > maxRecordLen {
+		return ErrTooLarge
+	}
+	return nil
+}
+
+// recordLen is a length of v2 record.
+// Max record len is 2,147,483,647 (2.147 GB) since the highest bit marks v2 records, see checkRecordLen.
+func recordLen(flags byte, key string, value []byte) uint32 {
+	blen := recordHeaderSize + flagsSize + keyLenSize + uint32(len(key)) + uint32(len(value))
+	if flags&flagExpires != 0 {
+		blen += expiresSize
+	}
+	return blen
+}
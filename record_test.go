@@ -0,0 +1,166 @@
+package rascaldb
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncode(t *testing.T) {
+	tt := []struct {
+		key   string
+		value []byte
+		want  []byte
+	}{
+		{
+			// [110 97 109 101]
+			key: "name",
+			// [66 111 98]
+			value: []byte("Bob"),
+			// record len with v2 bit (4 bytes) + checksum (4 bytes) + flags (1 byte) + key len (4 bytes) + key + value
+			want: []byte{20, 0, 0, 128, 225, 30, 162, 137, 0, 4, 0, 0, 0, 110, 97, 109, 101, 66, 111, 98},
+		},
+		{
+			// [97 0 98]
+			key:   "a\x00b",
+			value: []byte("v"),
+			want:  []byte{17, 0, 0, 128, 117, 122, 88, 99, 0, 3, 0, 0, 0, 97, 0, 98, 118},
+		},
+	}
+
+	for _, tc := range tt {
+		got := encode(tc.key, tc.value)
+		if !bytes.Equal(got, tc.want) {
+			t.Errorf("encode(%q, %v) = %v, want %v", tc.key, tc.value, got, tc.want)
+		}
+	}
+}
+
+func TestEncodeTombstone(t *testing.T) {
+	// record len with v2 bit (4 bytes) + checksum (4 bytes) + tombstone flag (1 byte) + key len (4 bytes) + key
+	want := []byte{17, 0, 0, 128, 127, 139, 182, 108, 1, 4, 0, 0, 0, 110, 97, 109, 101}
+	if got := encodeTombstone("name"); !bytes.Equal(got, want) {
+		t.Errorf("encodeTombstone(%q) = %v, want %v", "name", got, want)
+	}
+}
+
+func TestDecode(t *testing.T) {
+	tt := []struct {
+		name string
+		b    []byte
+		want record
+	}{
+		{
+			name: "v1 name=Bob",
+			b:    []byte{12, 0, 0, 0, 110, 97, 109, 101, 0, 66, 111, 98},
+			want: record{key: "name", value: []byte("Bob")},
+		},
+		{
+			name: "v1 name=empty",
+			b:    []byte{9, 0, 0, 0, 110, 97, 109, 101, 0},
+			want: record{key: "name", value: []byte{}},
+		},
+		{
+			name: "v2 name=Bob",
+			b:    []byte{20, 0, 0, 128, 225, 30, 162, 137, 0, 4, 0, 0, 0, 110, 97, 109, 101, 66, 111, 98},
+			want: record{key: "name", value: []byte("Bob")},
+		},
+		{
+			name: "v2 key with zero byte",
+			b:    []byte{17, 0, 0, 128, 117, 122, 88, 99, 0, 3, 0, 0, 0, 97, 0, 98, 118},
+			want: record{key: "a\x00b", value: []byte("v")},
+		},
+		{
+			name: "v2 name=empty",
+			b:    []byte{17, 0, 0, 128, 60, 159, 205, 123, 0, 4, 0, 0, 0, 110, 97, 109, 101},
+			want: record{key: "name", value: []byte{}},
+		},
+		{
+			name: "v2 tombstone",
+			b:    []byte{17, 0, 0, 128, 127, 139, 182, 108, 1, 4, 0, 0, 0, 110, 97, 109, 101},
+			want: record{key: "name", deleted: true},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := decode(tc.b)
+			if err != nil {
+				t.Fatalf("decode(%q) error %v", tc.b, err)
+			}
+			if r.key != tc.want.key {
+				t.Errorf("decode(%q) key %q, want %q", tc.b, r.key, tc.want.key)
+			}
+			if !bytes.Equal(r.value, tc.want.value) || (r.value == nil) != (tc.want.value == nil) {
+				t.Errorf("decode(%q) value %q, want %q", tc.b, r.value, tc.want.value)
+			}
+			if r.deleted != tc.want.deleted {
+				t.Errorf("decode(%q) deleted %t, want %t", tc.b, r.deleted, tc.want.deleted)
+			}
+		})
+	}
+}
+
+func TestEncodeBatchHeader(t *testing.T) {
+	r, err := decode(encodeBatchHeader(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.batch != 3 || r.key != "" || r.value != nil || r.deleted {
+		t.Errorf("decode(encodeBatchHeader(3)) = %+v, want batch of 3", r)
+	}
+}
+
+func TestEncodeExpiring(t *testing.T) {
+	const expires = 1700000000000000000
+	b := encodeExpiring("name", []byte("Bob"), expires)
+	if want := encode("name", []byte("Bob")); len(b) != len(want)+expiresSize {
+		t.Errorf("encodeExpiring() len %d, want %d", len(b), len(want)+expiresSize)
+	}
+	r, err := decode(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.key != "name" || string(r.value) != "Bob" || r.expires != expires || r.deleted {
+		t.Errorf("decode(encodeExpiring()) = %+v, want name=Bob expiring at %d", r, expires)
+	}
+
+	if b = encodeExpiring("name", []byte("Bob"), 0); !bytes.Equal(b, encode("name", []byte("Bob"))) {
+		t.Errorf("encodeExpiring() without expiration = %v, want v2 record without expiration time", b)
+	}
+}
+
+func TestDecode_error(t *testing.T) {
+	tt := []struct {
+		name string
+		b    []byte
+	}{
+		{
+			name: "v1 without delimiter",
+			b:    []byte{8, 0, 0, 0, 110, 97, 109, 101},
+		},
+		{
+			name: "no key len",
+			b:    []byte{9, 0, 0, 128, 0, 0, 0, 0, 0},
+		},
+		{
+			name: "batch without size",
+			b:    []byte{13, 0, 0, 128, 0, 0, 0, 0, 2, 0, 0, 0, 0},
+		},
+		{
+			name: "expiration time cut short",
+			b:    []byte{17, 0, 0, 128, 0, 0, 0, 0, 4, 0, 0, 0, 0, 1, 2, 3, 4},
+		},
+		{
+			name: "key len out of range",
+			b:    []byte{14, 0, 0, 128, 0, 0, 0, 0, 0, 2, 0, 0, 0, 97},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := decode(tc.b); err != ErrCorrupted {
+				t.Errorf("decode(%q) got %v, want %v", tc.b, err, ErrCorrupted)
+			}
+		})
+	}
+}
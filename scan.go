@@ -0,0 +1,206 @@
+package rascaldb
+
+import (
+	"iter"
+	"slices"
+	"time"
+)
+
+// Scan returns an iterator over live key-value pairs with keys in range [start, end) in ascending order.
+// Empty end means there is no upper bound.
+// Like Iterate, database is scanned as of the time the iteration started.
+// To fetch the next page after breaking the loop, scan again starting from the last key followed by a zero byte.
+// Scans are efficient only when database was opened with Options.OrderedIndex,
+// otherwise keys of every segment are sorted on each scan.
+// The iteration stops early if a record couldn't be read, use ScanFunc to get the error.
+func (db *DB) Scan(start, end string) iter.Seq2[string, []byte] {
+	return db.scan(start, end, false)
+}
+
+// ReverseScan is like Scan, but keys are iterated in descending order.
+// To fetch the next page after breaking the loop, scan again using the last key as end.
+func (db *DB) ReverseScan(start, end string) iter.Seq2[string, []byte] {
+	return db.scan(start, end, true)
+}
+
+// ScanPrefix is like Scan, but it iterates over keys which start with the prefix.
+func (db *DB) ScanPrefix(prefix string) iter.Seq2[string, []byte] {
+	return db.scan(prefix, prefixEnd(prefix), false)
+}
+
+// ScanFunc calls fn for every live key-value pair with keys in range [start, end) in ascending order like Scan.
+// The scan stops when fn returns an error, and that error is returned by ScanFunc.
+// Unlike Scan, it returns an error if the scan couldn't be completed, e.g., ErrClosed.
+func (db *DB) ScanFunc(start, end string, fn func(key string, value []byte) error) error {
+	return db.scanFunc(start, end, false, fn)
+}
+
+// ReverseScanFunc is like ScanFunc, but keys are iterated in descending order.
+func (db *DB) ReverseScanFunc(start, end string, fn func(key string, value []byte) error) error {
+	return db.scanFunc(start, end, true, fn)
+}
+
+// ScanPrefixFunc is like ScanFunc, but it iterates over keys which start with the prefix.
+func (db *DB) ScanPrefixFunc(prefix string, fn func(key string, value []byte) error) error {
+	return db.scanFunc(prefix, prefixEnd(prefix), false, fn)
+}
+
+// scan returns an iterator over the scan, see scanFunc.
+func (db *DB) scan(start, end string, reverse bool) iter.Seq2[string, []byte] {
+	return func(yield func(string, []byte) bool) {
+		db.scanFunc(start, end, reverse, func(key string, value []byte) error {
+			if !yield(key, value) {
+				return errStopIteration
+			}
+			return nil
+		})
+	}
+}
+
+// scanFunc scans a snapshot which is released when the scan is over.
+func (db *DB) scanFunc(start, end string, reverse bool, fn func(key string, value []byte) error) error {
+	snap, err := db.Snapshot()
+	if err != nil {
+		return err
+	}
+	err = snap.scanFunc(start, end, reverse, fn)
+	if rerr := snap.Release(); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// Scan is like DB.Scan, but it iterates over the snapshot.
+func (snap *Snapshot) Scan(start, end string) iter.Seq2[string, []byte] {
+	return snap.scan(start, end, false)
+}
+
+// ReverseScan is like DB.ReverseScan, but it iterates over the snapshot.
+func (snap *Snapshot) ReverseScan(start, end string) iter.Seq2[string, []byte] {
+	return snap.scan(start, end, true)
+}
+
+// ScanPrefix is like DB.ScanPrefix, but it iterates over the snapshot.
+func (snap *Snapshot) ScanPrefix(prefix string) iter.Seq2[string, []byte] {
+	return snap.scan(prefix, prefixEnd(prefix), false)
+}
+
+// ScanFunc is like DB.ScanFunc, but it scans the snapshot.
+func (snap *Snapshot) ScanFunc(start, end string, fn func(key string, value []byte) error) error {
+	return snap.scanFunc(start, end, false, fn)
+}
+
+// ReverseScanFunc is like DB.ReverseScanFunc, but it scans the snapshot.
+func (snap *Snapshot) ReverseScanFunc(start, end string, fn func(key string, value []byte) error) error {
+	return snap.scanFunc(start, end, true, fn)
+}
+
+// ScanPrefixFunc is like DB.ScanPrefixFunc, but it scans the snapshot.
+func (snap *Snapshot) ScanPrefixFunc(prefix string, fn func(key string, value []byte) error) error {
+	return snap.scanFunc(prefix, prefixEnd(prefix), false, fn)
+}
+
+// scan returns an iterator over the snapshot's scan, see scanFunc.
+func (snap *Snapshot) scan(start, end string, reverse bool) iter.Seq2[string, []byte] {
+	return func(yield func(string, []byte) bool) {
+		snap.scanFunc(start, end, reverse, func(key string, value []byte) error {
+			if !yield(key, value) {
+				return errStopIteration
+			}
+			return nil
+		})
+	}
+}
+
+// scanFunc merges ordered keys of the snapshot's segments.
+// When several segments have the same key, the newest segment wins.
+func (snap *Snapshot) scanFunc(start, end string, reverse bool, fn func(key string, value []byte) error) error {
+	if snap.released.Load() {
+		return ErrSnapshotReleased
+	}
+	if snap.db.closed.Load() {
+		return ErrClosed
+	}
+
+	now := time.Now().UnixNano()
+	n := len(snap.views)
+	nexts := make([]func() (string, bool), n)
+	heads := make([]string, n)
+	ok := make([]bool, n)
+	for i, s := range snap.views {
+		next, stop := iter.Pull(s.sortedKeys(start, end, reverse))
+		defer stop()
+		nexts[i] = next
+		heads[i], ok[i] = next()
+	}
+
+	for {
+		// Segments are checked from the oldest to the newest,
+		// so the newest segment is picked when keys are equal.
+		w := -1
+		for i := range heads {
+			if !ok[i] {
+				continue
+			}
+			if w == -1 || heads[i] == heads[w] || (heads[i] < heads[w]) != reverse {
+				w = i
+			}
+		}
+		if w == -1 {
+			return nil
+		}
+
+		s, key := snap.views[w], heads[w]
+		for i := range heads {
+			if ok[i] && heads[i] == key {
+				heads[i], ok[i] = nexts[i]()
+			}
+		}
+
+		e := s.index[key]
+		if e.deleted || e.expired(now) {
+			continue
+		}
+		_, value, err := s.read(e.offset)
+		if err != nil {
+			return err
+		}
+		if err = fn(key, value); err != nil {
+			return err
+		}
+	}
+}
+
+// sortedKeys returns an iterator over the segment's keys in range [start, end) in ascending order,
+// or descending if reverse is set. Empty end means there is no upper bound.
+// Without the ordered index the keys are collected from the hash map and sorted.
+func (s *segment) sortedKeys(start, end string, reverse bool) iter.Seq[string] {
+	if s.keys != nil {
+		return s.keys.keys(start, end, reverse)
+	}
+
+	var keys []string
+	for key := range s.index {
+		if key >= start && (end == "" || key < end) {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	if reverse {
+		slices.Reverse(keys)
+	}
+	return slices.Values(keys)
+}
+
+// prefixEnd returns the smallest key which is greater than all keys with the prefix,
+// or an empty string if there is no such key.
+func prefixEnd(prefix string) string {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1])
+		}
+	}
+	return ""
+}
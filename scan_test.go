@@ -0,0 +1,153 @@
+package rascaldb
+
+import (
+	"iter"
+	"slices"
+	"testing"
+)
+
+func TestDB_Scan(t *testing.T) {
+	t.Run("ordered index", func(t *testing.T) {
+		testScan(t, true)
+	})
+	t.Run("hash index", func(t *testing.T) {
+		testScan(t, false)
+	})
+}
+
+func testScan(t *testing.T, ordered bool) {
+	defer teardown()
+
+	dbpath := "testdata/scan.db"
+	// Segment header is 16 bytes and every record is 15 bytes long, so each segment fits two records.
+	opt := Options{MaxSegmentSize: 46, OrderedIndex: ordered}
+	db, err := OpenWithOptions(dbpath, &opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kv := []struct {
+		key   string
+		value string
+	}{
+		{"d", "1"},
+		{"b", "1"},
+		{"a", "1"},
+		{"e", "1"},
+		{"b", "2"},
+		{"c", "1"},
+		{"f", "1"},
+	}
+	for _, tc := range kv {
+		if err = db.Set(tc.key, []byte(tc.value)); err != nil {
+			t.Fatalf("Set(%q, %q) error %v", tc.key, tc.value, err)
+		}
+	}
+	if err = db.Delete("e"); err != nil {
+		t.Fatal(err)
+	}
+	// Sealed segments' ordered indexes are loaded from hint files and the current one from the segment.
+	db.Close()
+	if db, err = OpenWithOptions(dbpath, &opt); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	tt := []struct {
+		name string
+		seq  func() []string
+		want []string
+	}{
+		{"Scan", func() []string { return collect(db.Scan("", "")) }, []string{"a=1", "b=2", "c=1", "d=1", "f=1"}},
+		{"Scan range", func() []string { return collect(db.Scan("b", "e")) }, []string{"b=2", "c=1", "d=1"}},
+		{"ReverseScan", func() []string { return collect(db.ReverseScan("", "")) }, []string{"f=1", "d=1", "c=1", "b=2", "a=1"}},
+		{"ReverseScan range", func() []string { return collect(db.ReverseScan("b", "f")) }, []string{"d=1", "c=1", "b=2"}},
+		{"ScanPrefix", func() []string { return collect(db.ScanPrefix("c")) }, []string{"c=1"}},
+		{"ScanPrefix deleted", func() []string { return collect(db.ScanPrefix("e")) }, nil},
+	}
+	for _, tc := range tt {
+		if got := tc.seq(); !slices.Equal(got, tc.want) {
+			t.Errorf("%s got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+
+	// Keys are fetched two at a time.
+	var pages [][]string
+	for start := ""; ; {
+		var page []string
+		for key := range db.Scan(start, "") {
+			page = append(page, key)
+			if len(page) == 2 {
+				break
+			}
+		}
+		if len(page) == 0 {
+			break
+		}
+		pages = append(pages, page)
+		start = page[len(page)-1] + "\x00"
+	}
+	want := [][]string{{"a", "b"}, {"c", "d"}, {"f"}}
+	if !slices.EqualFunc(pages, want, slices.Equal) {
+		t.Errorf("Scan pages %q, want %q", pages, want)
+	}
+}
+
+func TestDB_ScanFunc(t *testing.T) {
+	defer teardown()
+
+	db, err := OpenWithOptions("testdata/scan.db", &Options{OrderedIndex: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"b", "a", "c"} {
+		if err = db.Set(key, []byte("1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got []string
+	err = db.ReverseScanFunc("", "", func(key string, value []byte) error {
+		got = append(got, key)
+		return nil
+	})
+	if err != nil || !slices.Equal(got, []string{"c", "b", "a"}) {
+		t.Errorf("ReverseScanFunc() got %q, %v, want [c b a]", got, err)
+	}
+	// The error of fn stops the scan.
+	errStop := Error("stop")
+	got = nil
+	err = db.ScanFunc("", "", func(key string, value []byte) error {
+		got = append(got, key)
+		return errStop
+	})
+	if err != errStop || !slices.Equal(got, []string{"a"}) {
+		t.Errorf("ScanFunc() got %q, %v, want [a], %v", got, err, errStop)
+	}
+
+	snap, err := db.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap.Release()
+	if err = snap.ScanPrefixFunc("a", func(string, []byte) error { return nil }); err != ErrSnapshotReleased {
+		t.Errorf("Snapshot.ScanPrefixFunc() error %v, want %v", err, ErrSnapshotReleased)
+	}
+
+	// The scan iterator yields nothing once db is closed, but ScanFunc reports why.
+	db.Close()
+	if got := collect(db.Scan("", "")); got != nil {
+		t.Errorf("Scan() after Close got %q", got)
+	}
+	if err = db.ScanFunc("", "", func(string, []byte) error { return nil }); err != ErrClosed {
+		t.Errorf("ScanFunc() after Close error %v, want %v", err, ErrClosed)
+	}
+}
+
+func collect(seq iter.Seq2[string, []byte]) []string {
+	var kv []string
+	for k, v := range seq {
+		kv = append(kv, k+"="+string(v))
+	}
+	return kv
+}
@@ -1,145 +1,544 @@
 package rascaldb
 
 import (
-	"bytes"
 	"encoding/binary"
 	"io"
 	"math/rand"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// recordLenSize is a record length in bytes needed to encode uint32.
-const recordLenSize = 4
+// Segment file starts with a header: magic (4 bytes), format version (4 bytes),
+// and creation time in Unix nanoseconds (8 bytes). Records follow the header.
+const (
+	// segmentMagic identifies RascalDB segment files.
+	segmentMagic = "RSCL"
+	// segmentVersion is the current segment format version.
+	segmentVersion = 1
+	// segmentHeaderSize is a size of the segment file header.
+	segmentHeaderSize = len(segmentMagic) + 4 + 8
+	// largeRecordLen is a record length (1 MB) above which the record is checked to fit the segment file
+	// before it is read.
+	largeRecordLen = 1 << 20
+)
 
-// kvDelimeter is a delimiter between key and value in segment's record.
-const kvDelimeter = byte('\x00')
+// segmentIDs is a counter of opened segments used to assign segment ids.
+var segmentIDs atomic.Uint64
 
 // segment represents a log file (append-only sequence of records).
 type segment struct {
 	// name is a segment's filename including the db dir.
 	name string
+	// id identifies the opened segment, e.g., in the cache which must not keep replaced segments in memory.
+	id uint64
+	// perm is a permission of the segment file and its hint file.
+	perm os.FileMode
+	// version is a segment format version from the header.
+	// It is zero for segments written before headers were introduced.
+	version uint32
+	// created is a time when the segment was created.
+	created time.Time
+	// start is an offset of the first record, i.e., it is the size of the header.
+	start int64
 	// fw is a File opened for writing logs.
 	fw *os.File
+	// lazySync defers fsync of written records until sync is called, see SyncPolicy.
+	// By default every write is flushed to disk.
+	lazySync bool
+	// dirty is set when records were written to fw but not flushed to disk yet.
+	dirty bool
+	// failed is set when a partially written record couldn't be truncated,
+	// so the segment must be rotated before the next write.
+	failed bool
 	// fr is a File opened for reads.
 	fr *os.File
-	// offset is an offset of the latest record appended to the file.
+	// offset is an offset where the next record will be appended to the file,
+	// i.e., it is the end of the latest record.
 	offset int64
+	// mark is set in a segment's view to the offset where the view ends.
+	// Records appended to the file after the mark are not indexed by loadIndex.
+	mark int64
+	// mu guards the index (and keys) of the current segment, since the index is read by concurrent Get calls
+	// while the actor updates it. Sealed segments' indexes don't change, so the lock is never contended.
+	mu sync.RWMutex
 	// index is a hash map which is used to index keys on disk.
-	// Every key is mapped to a byte offset in the segment file where value is stored.
-	index map[string]int64
+	// Every key is mapped to an entry which points to a record in the segment file where value is stored.
+	index map[string]entry
+	// keys is an ordered index of the keys which is maintained along with the hash map
+	// when database was opened with Options.OrderedIndex, otherwise it is nil.
+	keys *skiplist
+	// stale is a number of records which were overwritten by newer records with the same key.
+	// Those records can be dropped by compaction.
+	stale int
+	// deleted is a number of tombstone records, i.e., deleted keys.
+	deleted int
+	// expiring is a number of records which have an expiration time.
+	// Expired records can be dropped by compaction.
+	expiring int
+	// refs is a number of snapshots which reference the segment. It is guarded by DB.mu.
+	refs int
+	// hinting is used to wait for the hint file which is being written after the segment was sealed.
+	hinting sync.WaitGroup
+	// retired is set when the segment was replaced by compaction or merge,
+	// but it can't be deleted yet since snapshots still reference it. It is guarded by DB.mu.
+	retired bool
+}
+
+// entry is a location of a record in a segment file.
+type entry struct {
+	// offset is a byte offset of the record.
+	offset int64
+	// size is the record length in bytes.
+	size uint32
+	// deleted is set when the record is a tombstone.
+	deleted bool
+	// expires is an expiration time of the key in Unix nanoseconds, zero means the key doesn't expire.
+	expires int64
+}
+
+// expired reports whether the record's key has expired by now (Unix nanoseconds).
+func (e entry) expired(now int64) bool {
+	return e.expires != 0 && e.expires <= now
 }
 
 // openSegment opens a segment file for reads and writes if the segment is writable.
+// A new segment file is created with permissions perm.
+// A header is written to a new writable segment, otherwise the header is validated.
 // Note, you must call loadIndex to populate in-memory index.
-func openSegment(name string, writable bool) (*segment, error) {
+func openSegment(name string, writable bool, perm os.FileMode) (*segment, error) {
 	s := segment{
 		name:  name,
-		index: make(map[string]int64),
+		id:    segmentIDs.Add(1),
+		perm:  perm,
+		index: make(map[string]entry),
 	}
 
 	var err error
 	if writable {
-		if s.fw, err = os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600); err != nil {
+		if s.fw, err = os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, perm); err != nil {
+			return &s, err
+		}
+	}
+	if s.fr, err = os.Open(name); err != nil {
+		return &s, err
+	}
+
+	h := make([]byte, segmentHeaderSize)
+	n, err := s.fr.ReadAt(h, 0)
+	switch {
+	case err != nil && err != io.EOF:
+		return &s, err
+	case n == 0:
+		if writable {
+			err = s.writeHeader(time.Now())
+		}
+		return &s, err
+	case n < segmentHeaderSize && string(h[:min(n, len(segmentMagic))]) == segmentMagic[:min(n, len(segmentMagic))]:
+		// The header was partially written when db crashed, so the segment has no records yet.
+		// Like a partially written record, the torn header is discarded.
+		if !writable {
+			s.version = segmentVersion
+			s.start = int64(n)
+			s.offset = s.start
+			return &s, nil
+		}
+		if err = s.fw.Truncate(0); err != nil {
 			return &s, err
 		}
+		return &s, s.writeHeader(time.Now())
+	case n >= len(segmentMagic) && string(h[:len(segmentMagic)]) == segmentMagic:
+		return &s, s.decodeHeader(h[:n])
+	}
+
+	// Segments written before headers were introduced start with a v1 record.
+	// If the record is not valid, then it is not a segment file.
+	b, err := s.readRecord(0)
+	if err == nil {
+		_, err = decode(b)
+	}
+	if err != nil && err != io.EOF {
+		return &s, ErrSegmentHeader
 	}
-	s.fr, err = os.Open(name)
-	return &s, err
+	return &s, nil
+}
+
+// writeHeader writes the header to a new segment file.
+func (s *segment) writeHeader(created time.Time) error {
+	h := make([]byte, 0, segmentHeaderSize)
+	h = append(h, segmentMagic...)
+	h = binary.LittleEndian.AppendUint32(h, segmentVersion)
+	h = binary.LittleEndian.AppendUint64(h, uint64(created.UnixNano()))
+	if _, err := s.fw.Write(h); err != nil {
+		return err
+	}
+	if err := s.fw.Sync(); err != nil {
+		return err
+	}
+
+	return s.decodeHeader(h)
+}
+
+// decodeHeader validates the segment header h and sets the segment's version and creation time.
+func (s *segment) decodeHeader(h []byte) error {
+	if len(h) < segmentHeaderSize || string(h[:len(segmentMagic)]) != segmentMagic {
+		return ErrSegmentHeader
+	}
+	h = h[len(segmentMagic):]
+	if s.version = binary.LittleEndian.Uint32(h); s.version != segmentVersion {
+		return ErrSegmentVersion
+	}
+	s.created = time.Unix(0, int64(binary.LittleEndian.Uint64(h[4:])))
+	s.start = int64(segmentHeaderSize)
+	s.offset = s.start
+	return nil
 }
 
 // close closes a segment file which was opened for reads and maybe writes.
+// Records which weren't flushed to disk yet are flushed before the file is closed.
+// It waits for the hint file to be written, so the hint isn't left behind when the segment is removed.
 func (s *segment) close() error {
+	s.hinting.Wait()
 	if s.fr != nil {
 		s.fr.Close()
 	}
-	if s.fw != nil {
-		return s.fw.Close()
+	if s.fw == nil {
+		return nil
+	}
+	if err := s.sync(); err != nil {
+		s.fw.Close()
+		return err
+	}
+	return s.fw.Close()
+}
+
+// remove closes the segment and deletes its file along with the hint file.
+func (s *segment) remove() error {
+	s.close()
+	if err := os.Remove(hintName(s.name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Remove(s.name)
+}
+
+// seal flushes and closes the segment file opened for writes, so the segment becomes read-only.
+func (s *segment) seal() error {
+	if s.fw == nil {
+		return nil
+	}
+	err := s.flush()
+	if cerr := s.fw.Close(); err == nil {
+		err = cerr
 	}
+	s.fw = nil
+	return err
+}
+
+// flush flushes records written since the last sync to disk before the segment is sealed.
+// A partially written record left by a failed write is truncated, so the segment ends with a valid record.
+func (s *segment) flush() error {
+	if err := s.sync(); err != nil {
+		return err
+	}
+	if !s.failed {
+		return nil
+	}
+	if err := s.truncate(s.offset); err != nil {
+		return err
+	}
+	s.failed = false
 	return nil
 }
 
+// sync flushes records written since the last sync to disk.
+func (s *segment) sync() error {
+	if !s.dirty {
+		return nil
+	}
+	if err := s.fw.Sync(); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// syncWrite flushes the written records to disk unless fsync is deferred (lazySync).
+func (s *segment) syncWrite() error {
+	if s.lazySync {
+		return nil
+	}
+	return s.sync()
+}
+
+// size returns the segment file size in bytes.
+func (s *segment) size() (int64, error) {
+	fi, err := s.fr.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
 // read reads a key-value pair by the offset from the segment file.
+// If the record is a tombstone, the key is returned along with ErrKeyNotFound.
+// ErrCorrupted is returned when the record's checksum doesn't match or the record is cut short by the end of file.
+// Records without a checksum (v1) are read as is.
+// io.EOF means there are no more records.
 func (s *segment) read(offset int64) (string, []byte, error) {
-	recordLen := make([]byte, recordLenSize)
-	if _, err := s.fr.ReadAt(recordLen, offset); err != nil {
+	b, err := s.readRecord(offset)
+	if err != nil {
 		return "", nil, err
 	}
-	blen := binary.LittleEndian.Uint32(recordLen)
-
-	b := make([]byte, blen)
-	if _, err := s.fr.ReadAt(b, offset); err != nil {
+	r, err := decode(b)
+	if err != nil {
 		return "", nil, err
 	}
 
-	key, value := decode(b)
-	return key, value, nil
+	if r.deleted {
+		return r.key, nil, ErrKeyNotFound
+	}
+	return r.key, r.value, nil
+}
+
+// readRecord reads an encoded record by the offset from the segment file and verifies its checksum.
+// v1 records don't have a checksum, they are read only from segments without a header
+// which were written by older versions.
+func (s *segment) readRecord(offset int64) ([]byte, error) {
+	header := make([]byte, recordHeaderSize)
+	n, err := s.fr.ReadAt(header, offset)
+	switch {
+	case err != nil && err != io.EOF:
+		return nil, err
+	case n == 0:
+		return nil, io.EOF
+	case n < recordLenSize:
+		// Older versions stopped reading a segment when the record length couldn't be read,
+		// so the trailing bytes of their segments are ignored the same way.
+		if s.version == 0 {
+			return nil, io.EOF
+		}
+		return nil, ErrCorrupted
+	}
+	blen := binary.LittleEndian.Uint32(header)
+	v2 := blen&recordV2 != 0
+	blen &^= recordV2
+	if v2 && (n < recordHeaderSize || blen < recordHeaderSize) {
+		return nil, ErrCorrupted
+	}
+	if !v2 && (s.version != 0 || blen < recordLenSize) {
+		return nil, ErrCorrupted
+	}
+	// The length read at a wrong offset or from a corrupted record could be huge,
+	// so a large record is checked to fit the file before it is allocated.
+	if blen > largeRecordLen {
+		size, err := s.size()
+		if err != nil {
+			return nil, err
+		}
+		if offset+int64(blen) > size {
+			return nil, ErrCorrupted
+		}
+	}
+
+	b := make([]byte, blen)
+	if _, err = s.fr.ReadAt(b, offset); err != nil {
+		if err == io.EOF {
+			return nil, ErrCorrupted
+		}
+		return nil, err
+	}
+	if v2 && binary.LittleEndian.Uint32(b[recordLenSize:]) != checksum(b) {
+		return nil, ErrCorrupted
+	}
+	return b, nil
 }
 
 // write appends a key-value pair to a log file and updates the index.
 // Note, it is not concurrency safe. By design there should be only one writer.
 func (s *segment) write(key string, value []byte) error {
-	n, err := s.fw.Write(encode(key, value))
+	return s.writeRecord(key, encode(key, value), entry{})
+}
+
+// delete appends a tombstone record of the key to a log file and updates the index.
+// Note, it is not concurrency safe. By design there should be only one writer.
+func (s *segment) delete(key string) error {
+	return s.writeRecord(key, encodeTombstone(key), entry{deleted: true})
+}
+
+// writeRecord appends an encoded record b of the key, flushes it to disk (unless lazySync), and updates the index.
+// The record's offset and size are set in the entry e.
+func (s *segment) writeRecord(key string, b []byte, e entry) error {
+	offset, err := s.append(b)
 	if err != nil {
 		return err
 	}
-	if err := s.fw.Sync(); err != nil {
+	if err = s.syncWrite(); err != nil {
 		return err
 	}
-	s.index[key] = s.offset
-	s.offset += int64(n)
+	e.offset, e.size = offset, uint32(len(b))
+	s.mu.Lock()
+	s.put(key, e)
+	s.mu.Unlock()
 	return nil
 }
 
-// loadIndex loads keys from the segment file into in-memory index.
-// Note, it is not concurrency safe since it touches the index.
-func (s *segment) loadIndex() error {
-	var offset int64
-	for {
-		switch key, value, err := s.read(offset); err {
-		case nil:
-			s.index[key] = offset
-			offset += int64(recordLen(key, value))
-		case io.EOF:
-			return nil
-		default:
-			return err
+// writeBatch appends records of the batch as one unit, flushes them to disk (unless lazySync), and updates the index.
+// Note, it is not concurrency safe. By design there should be only one writer.
+func (s *segment) writeBatch(batch *Batch) error {
+	b, err := batch.encode()
+	if err != nil {
+		return err
+	}
+	return s.writeBatches([]encodedBatch{b})
+}
+
+// writeBatches appends records of the encoded batches with a single write, flushes them to disk (unless lazySync),
+// and updates the index.
+// Every batch is still a unit on its own, i.e., a torn batch doesn't affect the batches written before it.
+// Note, it is not concurrency safe. By design there should be only one writer.
+func (s *segment) writeBatches(batches []encodedBatch) error {
+	var b []byte
+	for _, batch := range batches {
+		b = append(b, batch.records...)
+	}
+	offset, err := s.append(b)
+	if err != nil {
+		return err
+	}
+	if err = s.syncWrite(); err != nil {
+		return err
+	}
+
+	// The whole group is indexed under one lock, so readers see either all records of a batch or none.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, batch := range batches {
+		for i, key := range batch.keys {
+			e := batch.entries[i]
+			e.offset += offset
+			s.put(key, e)
 		}
+		offset += int64(len(batch.records))
 	}
+	return nil
 }
 
-// encode prepares the key value pair to be stored in a file.
-// First 4 bytes store the length of a record. The rest of bytes are key-value (zero byte is used as a delimeter).
-func encode(key string, value []byte) []byte {
-	blen := recordLen(key, value)
-	b := make([]byte, recordLenSize, blen)
+// append appends an encoded record b to a log file without fsync and returns the record's offset.
+// A partially written record is truncated, otherwise the records appended after it
+// would be discarded along with it when db is opened.
+// If the file couldn't be truncated, the segment is marked as failed, so no records are appended to it.
+// Note, the index is not updated.
+func (s *segment) append(b []byte) (int64, error) {
+	offset := s.offset
+	if _, err := s.fw.Write(b); err != nil {
+		if terr := s.fw.Truncate(offset); terr != nil {
+			s.failed = true
+		}
+		return offset, err
+	}
+	s.offset += int64(len(b))
+	s.dirty = true
+	return offset, nil
+}
+
+// put indexes the key stored in the record e.
+// If the key was already indexed, its previous record becomes stale.
+// Note, s.mu must be held if the segment is visible to readers.
+func (s *segment) put(key string, e entry) {
+	if _, ok := s.index[key]; ok {
+		s.stale++
+	} else if s.keys != nil {
+		s.keys.insert(key)
+	}
+	if e.deleted {
+		s.deleted++
+	}
+	if e.expires != 0 {
+		s.expiring++
+	}
+	s.index[key] = e
+}
 
-	binary.LittleEndian.PutUint32(b, blen)
-	b = append(b, key...)
-	b = append(b, kvDelimeter)
-	b = append(b, value...)
-	return b
+// lookup returns the index entry of the key. It is safe to call concurrently with writes.
+func (s *segment) lookup(key string) (entry, bool) {
+	s.mu.RLock()
+	e, ok := s.index[key]
+	s.mu.RUnlock()
+	return e, ok
 }
 
-// decode returns key-value from encoded byte slice b.
-func decode(b []byte) (string, []byte) {
-	b = b[recordLenSize:]
-	i := bytes.IndexByte(b, kvDelimeter)
-	if i == -1 {
-		return "", nil
+// loadIndex loads keys from the segment file into in-memory index.
+// Records of a batch are indexed only when all of them are read.
+// It returns the offset where the last valid record (or batch) ends.
+// In case of ErrCorrupted that is the offset of the corrupted record (or the batch it belongs to).
+// Note, it is not concurrency safe since it touches the index.
+func (s *segment) loadIndex() (int64, error) {
+	var (
+		// end is an offset where the last indexed record or batch ends.
+		end = s.start
+		// batch keeps records of the batch until all of them are read.
+		batch      []indexedRecord
+		batchTotal int
+	)
+	for offset := end; ; {
+		if s.mark != 0 && offset >= s.mark {
+			return end, nil
+		}
+		b, err := s.readRecord(offset)
+		if err == io.EOF {
+			// The batch was partially written.
+			if batchTotal > 0 {
+				return end, ErrCorrupted
+			}
+			return end, nil
+		}
+		if err != nil {
+			return end, err
+		}
+		r, err := decode(b)
+		if err != nil {
+			return end, err
+		}
+		e := entry{offset: offset, size: uint32(len(b)), deleted: r.deleted, expires: r.expires}
+		offset += int64(len(b))
+
+		switch {
+		case r.batch > 0 && batchTotal > 0:
+			// Batches can't be nested.
+			return end, ErrCorrupted
+		case r.batch > 0:
+			batchTotal = r.batch
+		case batchTotal > 0:
+			batch = append(batch, indexedRecord{key: r.key, e: e})
+			if len(batch) < batchTotal {
+				continue
+			}
+			for _, ir := range batch {
+				s.put(ir.key, ir.e)
+			}
+			batch, batchTotal = batch[:0], 0
+			end = offset
+		default:
+			s.put(r.key, e)
+			end = offset
+		}
 	}
+}
 
-	key := string(b[0:i])
-	value := b[i+1:] // Skip delimeter and read till the end.
-	return key, value
+// indexedRecord is a key and its entry which are about to be indexed.
+type indexedRecord struct {
+	key string
+	e   entry
 }
 
-// recordLen is used to read next record in a segment file.
-// Max record len is 4,294,967,295 (4.295 GB).
-// For example, start from 0 offset, read key-value pair, move to offset += recordLen(key, value).
-func recordLen(key string, value []byte) uint32 {
-	return recordLenSize + uint32(len(key)) + 1 + uint32(len(value))
+// truncate discards records of the writable segment starting from the offset.
+// It is used to get rid of a partially written record at the end of file.
+func (s *segment) truncate(offset int64) error {
+	if err := s.fw.Truncate(offset); err != nil {
+		return err
+	}
+	return s.fw.Sync()
 }
 
 // newSegmentNamer returns segment filename generator which is safe for concurrent use.
@@ -23,7 +23,7 @@ func TestOpenSegment_error(t *testing.T) {
 
 	for _, tc := range tt {
 		t.Run(tc.name, func(t *testing.T) {
-			_, err := openSegment(tc.file, tc.current)
+			_, err := openSegment(tc.file, tc.current, 0600)
 			if _, ok := err.(*os.PathError); ok != tc.wantErr {
 				t.Errorf("openSegment(%q, %t) = %v, want %v", tc.file, tc.current, err, tc.wantErr)
 			}
@@ -33,6 +33,121 @@ func TestOpenSegment_error(t *testing.T) {
 	}
 }
 
+func TestOpenSegment_header(t *testing.T) {
+	s, err := openSegment("testdata/writesegment", true, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.close()
+	if s.version != segmentVersion || s.start != int64(segmentHeaderSize) || s.created.IsZero() {
+		t.Errorf("openSegment() new segment version %d, start %d, created %v", s.version, s.start, s.created)
+	}
+
+	created := s.created
+	if s, err = openSegment("testdata/writesegment", false, 0600); err != nil {
+		t.Fatal(err)
+	}
+	s.close()
+	if s.version != segmentVersion || !s.created.Equal(created) {
+		t.Errorf("openSegment() got version %d created %v, want %d %v", s.version, s.created, segmentVersion, created)
+	}
+
+	// Segment without a header is read from the beginning of file.
+	if s, err = openSegment("testdata/readsegment", false, 0600); err != nil {
+		t.Fatal(err)
+	}
+	s.close()
+	if s.version != 0 || s.start != 0 {
+		t.Errorf("openSegment() headerless segment version %d, start %d, want 0 0", s.version, s.start)
+	}
+
+	teardown()
+}
+
+func TestOpenSegment_v1(t *testing.T) {
+	// The segment was written by an older version: records have neither explicit key length nor checksum,
+	// and there is no segment header.
+	s, err := openSegment("testdata/readsegment", false, 0600)
+	if err != nil {
+		t.Fatalf("openSegment() error %v", err)
+	}
+	defer s.close()
+	if _, err = s.loadIndex(); err != nil {
+		t.Fatalf("loadIndex() error %v", err)
+	}
+
+	e, ok := s.index["name"]
+	if !ok || s.stale != 1 {
+		t.Fatalf("loadIndex() %q key indexed %t with %d stale records, want true and 1", "name", ok, s.stale)
+	}
+	key, value, err := s.read(e.offset)
+	if key != "name" || !bytes.Equal(value, []byte("Jon")) || err != nil {
+		t.Errorf("read(%d) = %q, %q, %v, want %q, %q", e.offset, key, value, err, "name", "Jon")
+	}
+}
+
+func TestOpenSegment_headerError(t *testing.T) {
+	tt := []struct {
+		name    string
+		content string
+		wantErr error
+	}{
+		{"not a segment", "hello world", ErrSegmentHeader},
+		{"v1 record without delimiter", "\x08\x00\x00\x00name", ErrSegmentHeader},
+		{"unknown version", "RSCL\x02\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00", ErrSegmentVersion},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := ioutil.WriteFile("testdata/writesegment", []byte(tc.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			s, err := openSegment("testdata/writesegment", false, 0600)
+			s.close()
+			if err != tc.wantErr {
+				t.Errorf("openSegment() got %v, want %v", err, tc.wantErr)
+			}
+
+			teardown()
+		})
+	}
+}
+
+func TestOpenSegment_tornHeader(t *testing.T) {
+	defer teardown()
+	for _, torn := range []string{"R", "RSCL", "RSCL\x01\x00"} {
+		if err := ioutil.WriteFile("testdata/writesegment", []byte(torn), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		// Read-only segment with a torn header has no records.
+		s, err := openSegment("testdata/writesegment", false, 0600)
+		if err != nil {
+			t.Fatalf("openSegment(%q) read-only error %v", torn, err)
+		}
+		if _, err = s.loadIndex(); err != nil || len(s.index) != 0 {
+			t.Errorf("loadIndex() of %q indexed %d keys, error %v", torn, len(s.index), err)
+		}
+		s.close()
+
+		// The header is written again to the writable segment.
+		if s, err = openSegment("testdata/writesegment", true, 0600); err != nil {
+			t.Fatalf("openSegment(%q) error %v", torn, err)
+		}
+		if err = s.write("name", []byte("Bob")); err != nil {
+			t.Fatal(err)
+		}
+		s.close()
+		if s, err = openSegment("testdata/writesegment", false, 0600); err != nil {
+			t.Fatalf("openSegment(%q) after header was rewritten error %v", torn, err)
+		}
+		if _, err = s.loadIndex(); err != nil || s.index["name"].offset != int64(segmentHeaderSize) {
+			t.Errorf("loadIndex() after header was rewritten got %v, error %v", s.index, err)
+		}
+		s.close()
+	}
+}
+
 func TestSegment_close(t *testing.T) {
 	s := segment{}
 	if err := s.close(); err != nil {
@@ -59,7 +174,7 @@ func TestSegment_close(t *testing.T) {
 }
 
 func TestSegment_read(t *testing.T) {
-	s, err := openSegment("testdata/readsegment", false)
+	s, err := openSegment("testdata/readsegment", false, 0600)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -111,7 +226,7 @@ func TestSegment_read(t *testing.T) {
 }
 
 func TestSegment_read_error(t *testing.T) {
-	s, err := openSegment("testdata/readsegment", false)
+	s, err := openSegment("testdata/readsegment", false, 0600)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -135,7 +250,7 @@ func TestSegment_read_error(t *testing.T) {
 		{
 			name:   "err wrong offset",
 			offset: 1,
-			err:    io.EOF,
+			err:    ErrCorrupted,
 		},
 		{
 			name:   "err offset out of range",
@@ -153,6 +268,27 @@ func TestSegment_read_error(t *testing.T) {
 	}
 }
 
+func TestSegment_read_checksum(t *testing.T) {
+	s, err := openSegment("testdata/writesegment", true, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardown()
+	defer s.close()
+
+	b := encode("name", []byte("Bob"))
+	// Value is changed from Bob to Rob, but the checksum is left as is.
+	b[len(b)-3] = 'R'
+	offset, err := s.append(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err = s.read(offset); err != ErrCorrupted {
+		t.Errorf("read(%d) got %v, want %v", offset, err, ErrCorrupted)
+	}
+}
+
 func TestSegment_write(t *testing.T) {
 	tt := []struct {
 		name           string
@@ -166,34 +302,37 @@ func TestSegment_write(t *testing.T) {
 			name:       "name=Bob",
 			key:        "name",
 			value:      []byte("Bob"),
-			wantRecord: []byte("\f\x00\x00\x00name\x00Bob"),
-			wantOffset: 0,
-			// 4 bytes for record len, key is 4 bytes, delimeter is 1 byte, value is 3 bytes.
-			wantNextOffset: 12,
+			wantRecord: []byte("\x14\x00\x00\x80\xe1\x1e\xa2\x89\x00\x04\x00\x00\x00nameBob"),
+			wantOffset: 16,
+			// 16 bytes for segment header, 4 bytes for record len, 4 bytes for checksum, 1 byte for flags, 4 bytes for key len,
+			// key is 4 bytes, value is 3 bytes.
+			wantNextOffset: 36,
 		},
 		{
 			name:       "name=nil",
 			key:        "name",
 			value:      nil,
-			wantRecord: []byte("\t\x00\x00\x00name\x00"),
-			wantOffset: 0,
-			// 4 bytes for record len, key is 4 bytes, delimeter is 1 byte, value is 0 bytes.
-			wantNextOffset: 9,
+			wantRecord: []byte("\x11\x00\x00\x80<\x9f\xcd{\x00\x04\x00\x00\x00name"),
+			wantOffset: 16,
+			// 16 bytes for segment header, 4 bytes for record len, 4 bytes for checksum, 1 byte for flags, 4 bytes for key len,
+			// key is 4 bytes, value is 0 bytes.
+			wantNextOffset: 33,
 		},
 		{
 			name:       "empty=Bob",
 			key:        "",
 			value:      []byte("Bob"),
-			wantRecord: []byte("\b\x00\x00\x00\x00Bob"),
-			wantOffset: 0,
-			// 4 bytes for record len, key is 0 bytes, delimeter is 1 byte, value is 3 bytes.
-			wantNextOffset: 8,
+			wantRecord: []byte("\x10\x00\x00\x80n\x05_#\x00\x00\x00\x00\x00Bob"),
+			wantOffset: 16,
+			// 16 bytes for segment header, 4 bytes for record len, 4 bytes for checksum, 1 byte for flags, 4 bytes for key len,
+			// key is 0 bytes, value is 3 bytes.
+			wantNextOffset: 32,
 		},
 	}
 
 	for _, tc := range tt {
 		t.Run(tc.name, func(t *testing.T) {
-			s, err := openSegment("testdata/writesegment", true)
+			s, err := openSegment("testdata/writesegment", true, 0600)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -203,16 +342,21 @@ func TestSegment_write(t *testing.T) {
 			}
 			s.close()
 
-			record, err := ioutil.ReadFile("testdata/writesegment")
+			b, err := ioutil.ReadFile("testdata/writesegment")
 			if err != nil {
 				t.Fatal(err)
 			}
+			// The record is written right after the segment header.
+			record := b[segmentHeaderSize:]
 			if !bytes.Equal(record, tc.wantRecord) {
 				t.Errorf("write(%q, %q) got %q, want %q", tc.key, tc.value, record, tc.wantRecord)
 			}
 
-			if s.index[tc.key] != tc.wantOffset {
-				t.Errorf("write(%q, %q) key offset %d, want %d", tc.key, tc.value, s.index[tc.key], tc.wantOffset)
+			if s.index[tc.key].offset != tc.wantOffset {
+				t.Errorf("write(%q, %q) key offset %d, want %d", tc.key, tc.value, s.index[tc.key].offset, tc.wantOffset)
+			}
+			if size := s.index[tc.key].size; int(size) != len(tc.wantRecord) {
+				t.Errorf("write(%q, %q) record size %d, want %d", tc.key, tc.value, size, len(tc.wantRecord))
 			}
 
 			if s.offset != tc.wantNextOffset {
@@ -224,74 +368,116 @@ func TestSegment_write(t *testing.T) {
 	}
 }
 
-func TestSegment_loadIndex(t *testing.T) {
-	s, err := openSegment("testdata/readsegment", false)
+func TestSegment_delete(t *testing.T) {
+	s, err := openSegment("testdata/writesegment", true, 0600)
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer teardown()
 	defer s.close()
 
-	if err := s.loadIndex(); err != nil {
-		t.Errorf("loadIndex() error: %v", err)
+	if err = s.write("name", []byte("Bob")); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.delete("name"); err != nil {
+		t.Fatal(err)
 	}
 
-	key := "name"
-	offset, ok := s.index[key]
-	if !ok {
-		t.Errorf("loadIndex() %q key is not indexed", key)
+	// The tombstone is written right after the segment header (16 bytes) and name=Bob record (20 bytes).
+	const wantOffset = 36
+	if e := s.index["name"]; e.offset != wantOffset || !e.deleted {
+		t.Errorf("delete(%q) key offset %d deleted %t, want %d true", "name", e.offset, e.deleted, wantOffset)
+	}
+	if s.stale != 1 || s.deleted != 1 {
+		t.Errorf("delete(%q) stale %d and deleted %d, want 1 and 1", "name", s.stale, s.deleted)
 	}
 
-	const want = 12
-	if offset != want {
-		t.Errorf("loadIndex() %q key offset is %d, want %d", key, offset, want)
+	key, value, err := s.read(wantOffset)
+	if key != "name" || value != nil || err != ErrKeyNotFound {
+		t.Errorf("read(%d) = %q, %q, %v, want %q, nil, %v", wantOffset, key, value, err, "name", ErrKeyNotFound)
+	}
+
+	loaded, err := openSegment("testdata/writesegment", false, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loaded.close()
+	if _, err = loaded.loadIndex(); err != nil {
+		t.Fatalf("loadIndex() error: %v", err)
+	}
+	if e := loaded.index["name"]; e.offset != wantOffset || !e.deleted || loaded.deleted != 1 {
+		t.Errorf("loadIndex() tombstone offset %d and deleted %d, want %d and 1", e.offset, loaded.deleted, wantOffset)
 	}
 }
 
-func TestEncode(t *testing.T) {
-	tt := []struct {
-		key   string
-		value []byte
-		want  []byte
-	}{
-		{
-			// [110 97 109 101]
-			key: "name",
-			// [66 111 98]
-			value: []byte("Bob"),
-			// record len (4 bytes) + key + delimeter (1 byte) + value
-			want: []byte{12, 0, 0, 0, 110, 97, 109, 101, 0, 66, 111, 98},
-		},
+func TestSegment_loadIndex_mixed(t *testing.T) {
+	v1, err := ioutil.ReadFile("testdata/readsegment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The trailing newline of the segment is not a record.
+	v1 = bytes.TrimSuffix(v1, []byte("\n"))
+	if err = ioutil.WriteFile("testdata/writesegment", v1, 0600); err != nil {
+		t.Fatal(err)
 	}
+	defer teardown()
 
-	for _, tc := range tt {
-		got := encode(tc.key, tc.value)
-		if !bytes.Equal(got, tc.want) {
-			t.Errorf("encode(%q, %v) = %v, want %v", tc.key, tc.value, got, tc.want)
+	// v2 records are appended to a segment which has v1 records.
+	s, err := openSegment("testdata/writesegment", true, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.offset = int64(len(v1))
+	if err = s.write("a\x00b", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	s.close()
+
+	if s, err = openSegment("testdata/writesegment", false, 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	if _, err = s.loadIndex(); err != nil {
+		t.Fatalf("loadIndex() error: %v", err)
+	}
+
+	want := map[string]string{"name": "Jon", "a\x00b": "v"}
+	if len(s.index) != len(want) {
+		t.Errorf("loadIndex() indexed %d keys, want %d", len(s.index), len(want))
+	}
+	for k, v := range want {
+		_, value, err := s.read(s.index[k].offset)
+		if err != nil || !bytes.Equal(value, []byte(v)) {
+			t.Errorf("read(%q) = %q, %v, want %q", k, value, err, v)
 		}
 	}
 }
 
-func TestDecode(t *testing.T) {
-	tt := []struct {
-		b         []byte
-		wantKey   string
-		wantValue []byte
-	}{
-		{
-			b:         []byte{12, 0, 0, 0, 110, 97, 109, 101, 0, 66, 111, 98},
-			wantKey:   "name",
-			wantValue: []byte("Bob"),
-		},
+func TestSegment_loadIndex(t *testing.T) {
+	s, err := openSegment("testdata/readsegment", false, 0600)
+	if err != nil {
+		t.Fatal(err)
 	}
+	defer s.close()
 
-	for _, tc := range tt {
-		key, value := decode(tc.b)
-		if key != tc.wantKey {
-			t.Errorf("decode(%q) key %q, want %q", tc.b, key, tc.wantKey)
-		}
-		if !bytes.Equal(value, tc.wantValue) {
-			t.Errorf("decode(%q) value %q, want %q", tc.b, value, tc.wantValue)
-		}
+	end, err := s.loadIndex()
+	if err != nil {
+		t.Errorf("loadIndex() error: %v", err)
+	}
+	// The trailing newline of the segment is ignored since it is not a record.
+	if wantEnd := int64(24); end != wantEnd {
+		t.Errorf("loadIndex() end offset is %d, want %d", end, wantEnd)
+	}
+
+	key := "name"
+	e, ok := s.index[key]
+	if !ok {
+		t.Errorf("loadIndex() %q key is not indexed", key)
+	}
+
+	const want = 12
+	if e.offset != want || e.size != 12 {
+		t.Errorf("loadIndex() %q key offset is %d and size %d, want %d and 12", key, e.offset, e.size, want)
 	}
 }
 
@@ -0,0 +1,151 @@
+package rascaldb
+
+import (
+	"iter"
+	"math/bits"
+	"math/rand/v2"
+)
+
+// skiplistMaxLevel is enough for 4^24 keys since every level has a quarter of keys of the level below.
+const skiplistMaxLevel = 24
+
+// skiplist is an ordered set of keys which is used as an ordered index of a segment
+// along with the hash map which still serves point lookups.
+// Keys are never removed, because a segment index only grows.
+// Note, it is not concurrency safe. By design there should be only one writer.
+type skiplist struct {
+	head skipnode
+	// tail is the last node, it is where reverse iteration starts.
+	tail *skipnode
+	// level is the highest level of nodes in the list.
+	level int
+}
+
+// skipnode is a key in the skiplist. Nodes are linked forward on every level of the node
+// and backward on the lowest level to iterate in reverse.
+type skipnode struct {
+	key  string
+	prev *skipnode
+	next []*skipnode
+}
+
+// newSkiplist returns an empty skiplist.
+func newSkiplist() *skiplist {
+	return &skiplist{
+		head: skipnode{next: make([]*skipnode, skiplistMaxLevel)},
+	}
+}
+
+// insert adds the key to the skiplist if it isn't there yet.
+func (l *skiplist) insert(key string) {
+	var update [skiplistMaxLevel]*skipnode
+	x := &l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].key < key {
+			x = x.next[i]
+		}
+		update[i] = x
+	}
+	if n := x.next[0]; n != nil && n.key == key {
+		return
+	}
+
+	level := randomLevel()
+	for i := l.level; i < level; i++ {
+		update[i] = &l.head
+	}
+	l.level = max(l.level, level)
+
+	n := skipnode{
+		key:  key,
+		next: make([]*skipnode, level),
+	}
+	for i := range n.next {
+		n.next[i] = update[i].next[i]
+		update[i].next[i] = &n
+	}
+	if update[0] != &l.head {
+		n.prev = update[0]
+	}
+	if n.next[0] != nil {
+		n.next[0].prev = &n
+	} else {
+		l.tail = &n
+	}
+}
+
+// randomLevel returns a level of a new node: 1 with probability 3/4, 2 with 3/16, and so on.
+func randomLevel() int {
+	return min(bits.TrailingZeros64(rand.Uint64())/2+1, skiplistMaxLevel)
+}
+
+// before returns the last node whose key is less than the key, or nil if there is none.
+func (l *skiplist) before(key string) *skipnode {
+	x := &l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].key < key {
+			x = x.next[i]
+		}
+	}
+	if x == &l.head {
+		return nil
+	}
+	return x
+}
+
+// keys returns an iterator over keys in range [start, end) in ascending order, or descending if reverse is set.
+// Empty end means there is no upper bound.
+func (l *skiplist) keys(start, end string, reverse bool) iter.Seq[string] {
+	return func(yield func(string) bool) {
+		if !reverse {
+			x := l.head.next[0]
+			if b := l.before(start); b != nil {
+				x = b.next[0]
+			}
+			for ; x != nil && (end == "" || x.key < end); x = x.next[0] {
+				if !yield(x.key) {
+					return
+				}
+			}
+			return
+		}
+
+		x := l.tail
+		if end != "" {
+			x = l.before(end)
+		}
+		for ; x != nil && x.key >= start; x = x.prev {
+			if !yield(x.key) {
+				return
+			}
+		}
+	}
+}
+
+// clone returns a copy of the skiplist. Nodes are copied in order keeping their levels,
+// so it takes linear time.
+func (l *skiplist) clone() *skiplist {
+	c := newSkiplist()
+	c.level = l.level
+
+	// tails are the last copied nodes on every level.
+	var tails [skiplistMaxLevel]*skipnode
+	for i := range tails {
+		tails[i] = &c.head
+	}
+	for x := l.head.next[0]; x != nil; x = x.next[0] {
+		n := skipnode{
+			key:  x.key,
+			next: make([]*skipnode, len(x.next)),
+		}
+		if tails[0] != &c.head {
+			n.prev = tails[0]
+		}
+		for i := range n.next {
+			tails[i].next[i] = &n
+			tails[i] = &n
+		}
+		c.tail = &n
+	}
+	return c
+}
@@ -0,0 +1,69 @@
+package rascaldb
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"testing"
+)
+
+func TestSkiplist(t *testing.T) {
+	l := newSkiplist()
+	var want []string
+	for _, i := range rand.Perm(1000) {
+		key := fmt.Sprintf("%04d", i)
+		l.insert(key)
+		// Duplicate keys are ignored.
+		l.insert(key)
+		want = append(want, key)
+	}
+	slices.Sort(want)
+
+	tt := []struct {
+		name       string
+		start, end string
+		reverse    bool
+		want       []string
+	}{
+		{"all", "", "", false, want},
+		{"all reverse", "", "", true, reversed(want)},
+		{"range", "0100", "0200", false, want[100:200]},
+		{"range reverse", "0100", "0200", true, reversed(want[100:200])},
+		{"start between keys", "01000", "0102", false, want[101:102]},
+		{"no upper bound", "0990", "", false, want[990:]},
+		{"empty", "0200", "0100", false, nil},
+		{"past the end", "1000", "", false, nil},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, l := range []*skiplist{l, l.clone()} {
+				got := slices.Collect(l.keys(tc.start, tc.end, tc.reverse))
+				if !slices.Equal(got, tc.want) {
+					t.Errorf("keys(%q, %q, %t) = %d keys, want %d", tc.start, tc.end, tc.reverse, len(got), len(tc.want))
+				}
+			}
+		})
+	}
+}
+
+func reversed(keys []string) []string {
+	r := slices.Clone(keys)
+	slices.Reverse(r)
+	return r
+}
+
+func TestPrefixEnd(t *testing.T) {
+	tt := map[string]string{
+		"":                "",
+		"a":               "b",
+		"tenant/":         "tenant0",
+		"a\xff":           "b",
+		"\xff\xff":        "",
+		"tenant/\xff\x01": "tenant/\xff\x02",
+	}
+	for prefix, want := range tt {
+		if got := prefixEnd(prefix); got != want {
+			t.Errorf("prefixEnd(%q) = %q, want %q", prefix, got, want)
+		}
+	}
+}
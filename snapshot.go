@@ -0,0 +1,196 @@
+package rascaldb
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// Snapshot is a read-only view of database as of the time it was created by DB.Snapshot.
+// Writes made after that are not visible through the snapshot.
+// Segments referenced by the snapshot are not deleted by compaction or merge until Release is called.
+// Snapshot can be read concurrently, but it must not be used after Release.
+type Snapshot struct {
+	db *DB
+	// segments are database segments referenced by the snapshot.
+	segments []*segment
+	// views are the segments as seen by the snapshot.
+	// The current segment is represented by its copy which indexes only records written before snapshot creation,
+	// so records appended later are not visible.
+	views []*segment
+	// released is set by Release.
+	released atomic.Bool
+}
+
+// Snapshot returns a consistent read-only view of database.
+// Make sure to call Release when the snapshot is no longer needed, so compacted segments can be deleted.
+func (db *DB) Snapshot() (*Snapshot, error) {
+	return db.SnapshotContext(context.Background())
+}
+
+// SnapshotContext is like Snapshot, but it returns ctx.Err() when the context is done before the snapshot is created.
+func (db *DB) SnapshotContext(ctx context.Context) (*Snapshot, error) {
+	snap := Snapshot{db: db}
+	// The end of the current segment is marked in the actor, so no writes happen meanwhile.
+	// The segment's records up to the mark are indexed outside of the actor to not delay writes.
+	var mark int64
+	// taken is set by whoever comes first: the actor once it referenced the segments,
+	// or the caller which stopped waiting because the context is done.
+	// If the caller gave up, the one who comes second releases the segments of the abandoned snapshot.
+	var taken atomic.Bool
+	err := db.do(ctx, func() error {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+
+		ss := db.segments.Load().([]*segment)
+		for _, s := range ss {
+			s.refs++
+		}
+		snap.segments = ss
+		mark = ss[len(ss)-1].offset
+		if taken.Swap(true) {
+			for _, s := range ss {
+				s.refs--
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		if taken.Swap(true) {
+			snap.Release()
+		}
+		return nil, err
+	}
+
+	ss := snap.segments
+	snap.views = make([]*segment, len(ss))
+	copy(snap.views, ss[:len(ss)-1])
+	if snap.views[len(ss)-1], err = ss[len(ss)-1].view(mark); err != nil {
+		snap.Release()
+		return nil, err
+	}
+	return &snap, nil
+}
+
+// Get retrieves a key as it was when the snapshot was created.
+// ErrKeyNotFound is returned when the key didn't exist or was deleted.
+func (snap *Snapshot) Get(key string) ([]byte, error) {
+	if snap.released.Load() {
+		return nil, ErrSnapshotReleased
+	}
+	if snap.db.closed.Load() {
+		return nil, ErrClosed
+	}
+	return locate(snap.views, key).read()
+}
+
+// GetBytes is like Get, but the key is a byte slice.
+func (snap *Snapshot) GetBytes(key []byte) ([]byte, error) {
+	return snap.Get(string(key))
+}
+
+// Iterate calls fn for every key-value pair of the snapshot in no particular order.
+// Overwritten, deleted, and expired keys are skipped.
+// The iteration stops when fn returns an error, and that error is returned by Iterate.
+func (snap *Snapshot) Iterate(fn func(key string, value []byte) error) error {
+	if snap.released.Load() {
+		return ErrSnapshotReleased
+	}
+	if snap.db.closed.Load() {
+		return ErrClosed
+	}
+	now := time.Now().UnixNano()
+
+	// Segments are traversed from the newest to the oldest, so a key found in a newer segment
+	// shadows the same key in older ones.
+	seen := make(map[string]struct{})
+	for i := len(snap.views) - 1; i >= 0; i-- {
+		s := snap.views[i]
+		for key, e := range s.index {
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+			if e.deleted || e.expired(now) {
+				continue
+			}
+
+			_, value, err := s.read(e.offset)
+			if err != nil {
+				return err
+			}
+			if err = fn(key, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Release releases the segments referenced by the snapshot.
+// Segments which were replaced by compaction or merge in the meantime are deleted.
+// It is safe to call Release more than once.
+func (snap *Snapshot) Release() error {
+	if snap.released.Swap(true) {
+		return nil
+	}
+
+	db := snap.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var err error
+	for _, s := range snap.segments {
+		if s.refs--; s.refs > 0 || !s.retired {
+			continue
+		}
+		delete(db.retired, s)
+		if rerr := s.remove(); rerr != nil && err == nil {
+			err = rerr
+		}
+	}
+	return err
+}
+
+// retire deletes files of the segments which were replaced by compaction or merge.
+// Segments referenced by snapshots are deleted when the last of the snapshots is released.
+func (db *DB) retire(olds []*segment) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, s := range olds {
+		if s.refs > 0 {
+			s.retired = true
+			db.retired[s] = struct{}{}
+			continue
+		}
+		if err := s.remove(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// view returns a copy of the segment which indexes only the records before the offset mark.
+// The copy's index is loaded from the file, so the segment's index isn't locked meanwhile.
+// The copy shares the file opened for reads with the segment and it is never written to.
+func (s *segment) view(mark int64) (*segment, error) {
+	v := segment{
+		name:    s.name,
+		id:      s.id,
+		version: s.version,
+		created: s.created,
+		start:   s.start,
+		fr:      s.fr,
+		offset:  mark,
+		mark:    mark,
+		index:   make(map[string]entry),
+	}
+	if s.keys != nil {
+		v.keys = newSkiplist()
+	}
+	if _, err := v.loadIndex(); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
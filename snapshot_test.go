@@ -0,0 +1,168 @@
+package rascaldb
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestDB_Snapshot(t *testing.T) {
+	dbpath := "testdata/snapshot.db"
+	db, err := Open(dbpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, key := range []string{"a", "b", "c"} {
+		if err = db.Set(key, []byte("1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snap, err := db.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot() error %v", err)
+	}
+	// Writes made after the snapshot was created must not be visible.
+	if err = db.Set("a", []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Set("d", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := snap.Get("a"); err != nil || !bytes.Equal(got, []byte("1")) {
+		t.Errorf("Snapshot.Get(%q) = %q, %v, want %q", "a", got, err, "1")
+	}
+	if got, err := snap.Get("b"); err != nil || !bytes.Equal(got, []byte("1")) {
+		t.Errorf("Snapshot.Get(%q) = %q, %v, want %q", "b", got, err, "1")
+	}
+	if _, err = snap.Get("d"); err != ErrKeyNotFound {
+		t.Errorf("Snapshot.Get(%q) error %v, want %v", "d", err, ErrKeyNotFound)
+	}
+
+	got := make(map[string]string)
+	err = snap.Iterate(func(key string, value []byte) error {
+		got[key] = string(value)
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Snapshot.Iterate() error %v", err)
+	}
+	want := map[string]string{"a": "1", "b": "1", "c": "1"}
+	if len(got) != len(want) {
+		t.Errorf("Snapshot.Iterate() got %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("Snapshot.Iterate() key %q = %q, want %q", k, got[k], v)
+		}
+	}
+
+	if err = snap.Release(); err != nil {
+		t.Errorf("Release() error %v", err)
+	}
+	if err = snap.Release(); err != nil {
+		t.Errorf("Release() twice error %v", err)
+	}
+	if _, err = snap.Get("a"); err != ErrSnapshotReleased {
+		t.Errorf("Snapshot.Get(%q) error %v, want %v", "a", err, ErrSnapshotReleased)
+	}
+
+	teardown()
+}
+
+func TestSnapshot_Release(t *testing.T) {
+	dbpath := "testdata/snapshot.db"
+	// Segment header is 16 bytes and every record is 15 bytes long, so each segment fits two records.
+	db, err := OpenWithOptions(dbpath, &Options{MaxSegmentSize: 46})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, v := range []string{"1", "2", "3"} {
+		if err = db.Set("a", []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snap, err := db.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot() error %v", err)
+	}
+
+	before := db.segments.Load().([]*segment)
+	if err = db.Compact(); err != nil {
+		t.Fatalf("Compact() error %v", err)
+	}
+	// The compacted segment is referenced by the snapshot, so it must not be deleted yet.
+	sealed := before[0]
+	if after := db.segments.Load().([]*segment); after[0] == sealed {
+		t.Fatalf("Compact() segment %q was not replaced", sealed.name)
+	}
+	if _, err = os.Stat(sealed.name); err != nil {
+		t.Errorf("Compact() segment file %q: %v", sealed.name, err)
+	}
+	if err = db.Merge(); err != nil {
+		t.Fatalf("Merge() error %v", err)
+	}
+	if got, err := snap.Get("a"); err != nil || !bytes.Equal(got, []byte("3")) {
+		t.Errorf("Snapshot.Get(%q) = %q, %v, want %q", "a", got, err, "3")
+	}
+
+	if err = snap.Release(); err != nil {
+		t.Errorf("Release() error %v", err)
+	}
+	if _, err = os.Stat(sealed.name); !os.IsNotExist(err) {
+		t.Errorf("Release() segment file %q was not removed", sealed.name)
+	}
+	if got, err := db.Get("a"); err != nil || !bytes.Equal(got, []byte("3")) {
+		t.Errorf("Get(%q) = %q, %v, want %q", "a", got, err, "3")
+	}
+
+	teardown()
+}
+
+func TestSegment_view(t *testing.T) {
+	defer teardown()
+	s, err := openSegment("testdata/writesegment", true, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	s.keys = newSkiplist()
+
+	for _, key := range []string{"a", "b"} {
+		if err = s.write(key, []byte("1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mark, want := s.offset, s.index["a"]
+	// Records written after the mark must not be visible in the view.
+	for _, key := range []string{"a", "c"} {
+		if err = s.write(key, []byte("2")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	v, err := s.view(mark)
+	if err != nil {
+		t.Fatalf("view() error %v", err)
+	}
+	if got := v.index["a"]; got != want {
+		t.Errorf("view() indexed %q at %+v, want %+v", "a", got, want)
+	}
+	if _, ok := v.index["c"]; ok {
+		t.Errorf("view() indexed %q written after the mark", "c")
+	}
+	var keys []string
+	for key := range v.sortedKeys("", "", false) {
+		keys = append(keys, key)
+	}
+	if len(keys) != 2 || keys[0] != "a" || keys[1] != "b" {
+		t.Errorf("view() ordered keys %q, want [a b]", keys)
+	}
+}
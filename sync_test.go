@@ -0,0 +1,116 @@
+package rascaldb
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDB_Sync(t *testing.T) {
+	dbpath := "testdata/sync.db"
+	tt := []struct {
+		policy    SyncPolicy
+		wantDirty bool
+	}{
+		{SyncAlways, false},
+		{SyncPeriodic, true},
+		{SyncNever, true},
+	}
+	for _, tc := range tt {
+		// The period is long enough, so writes are not flushed in background during the test.
+		db, err := OpenWithOptions(dbpath, &Options{SyncPolicy: tc.policy, SyncPeriod: time.Hour})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = db.Set("a", []byte("1")); err != nil {
+			t.Fatal(err)
+		}
+		if dirty := isDirty(t, db); dirty != tc.wantDirty {
+			t.Errorf("policy %d: Set() left unflushed writes %t, want %t", tc.policy, dirty, tc.wantDirty)
+		}
+		if err = db.Sync(); err != nil {
+			t.Errorf("policy %d: Sync() error %v", tc.policy, err)
+		}
+		if isDirty(t, db) {
+			t.Errorf("policy %d: Sync() left unflushed writes", tc.policy)
+		}
+		db.Close()
+		teardown()
+	}
+}
+
+func TestDB_Sync_periodic(t *testing.T) {
+	dbpath := "testdata/sync.db"
+	db, err := OpenWithOptions(dbpath, &Options{SyncPolicy: SyncPeriodic, SyncPeriod: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Set("a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); isDirty(t, db); {
+		if time.Now().After(deadline) {
+			t.Fatal("writes were not flushed in background")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	teardown()
+}
+
+func TestDB_Set_rotateFlush(t *testing.T) {
+	dbpath := "testdata/sync.db"
+	// Segment header is 16 bytes and a record is 15 bytes long, so the second write rotates segments.
+	db, err := OpenWithOptions(dbpath, &Options{SyncPolicy: SyncNever, MaxSegmentSize: 31})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardown()
+	defer db.Close()
+	if err = db.Set("a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The trunk can't be written since its temporary file is a dir.
+	tmp := filepath.Join(dbpath, trunk) + ".tmp"
+	if err = os.Mkdir(tmp, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Set("b", []byte("2")); err == nil {
+		t.Fatalf("Set(%q) expected error", "b")
+	}
+	// The current segment was flushed before the trunk was written.
+	if ss := db.segments.Load().([]*segment); len(ss) != 1 {
+		t.Errorf("Set(%q) got segments %d, want 1", "b", len(ss))
+	}
+	if isDirty(t, db) {
+		t.Errorf("Set(%q) left unflushed writes in the segment being sealed", "b")
+	}
+
+	os.Remove(tmp)
+	if err = db.Set("b", []byte("2")); err != nil {
+		t.Fatalf("Set(%q) error %v", "b", err)
+	}
+	if ss := db.segments.Load().([]*segment); len(ss) != 2 {
+		t.Errorf("Set(%q) got segments %d, want 2", "b", len(ss))
+	}
+}
+
+// isDirty reports whether the current segment has writes which weren't flushed to disk.
+func isDirty(t *testing.T, db *DB) bool {
+	t.Helper()
+	var dirty bool
+	err := db.do(context.Background(), func() error {
+		ss := db.segments.Load().([]*segment)
+		dirty = ss[len(ss)-1].dirty
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dirty
+}
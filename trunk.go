@@ -2,7 +2,11 @@ package rascaldb
 
 import (
 	"bufio"
+	"bytes"
+	"fmt"
+	"hash/crc32"
 	"os"
+	"path/filepath"
 )
 
 // trunk is a file where the list of segment filenames is stored.
@@ -10,43 +14,109 @@ import (
 // Oldest segments are in the beginning of the list.
 const trunk = "trunk.txt"
 
+// trunkChecksumPrefix starts the first line of the trunk which contains CRC-32 checksum of segment names
+// listed after it, e.g., "crc32 5d6c8cd1". Trunks written by older versions don't have the checksum.
+const trunkChecksumPrefix = "crc32 "
+
 // readSegmentNames returns a slice of segment filenames stored in a special trunk file (sequence of segments).
 // That way we know in which order segments should be traversed when looking for a key.
+// ErrTrunkCorrupted is returned when the trunk was partially written, its checksum doesn't match,
+// or it has no segments.
 func readSegmentNames(path string) ([]string, error) {
-	f, err := os.Open(path)
+	b, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
+	// Every line ends with a newline, otherwise the file was cut short.
+	if len(b) == 0 || b[len(b)-1] != '\n' {
+		return nil, ErrTrunkCorrupted
+	}
+
+	names := b
+	// The checksum comes first, so a trunk cut short at a line boundary doesn't match its checksum.
+	if bytes.HasPrefix(b, []byte(trunkChecksumPrefix)) {
+		i := bytes.IndexByte(b, '\n') + 1
+		names = b[i:]
+		if string(b[:i]) != checksumLine(names) {
+			return nil, ErrTrunkCorrupted
+		}
+	}
 
 	var files []string
-	scanner := bufio.NewScanner(f)
+	scanner := bufio.NewScanner(bytes.NewReader(names))
 	for scanner.Scan() {
+		if scanner.Text() == "" {
+			return nil, ErrTrunkCorrupted
+		}
 		files = append(files, scanner.Text())
 	}
-	return files, scanner.Err()
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	// There is always at least one segment where new records are appended.
+	if len(files) == 0 {
+		return nil, ErrTrunkCorrupted
+	}
+	return files, nil
 }
 
 // writeSegmentNames stores a slice of segment filenames in a special trunk file (sequence of segments).
 // That way we know in which order segments should be traversed when looking for a key.
-func writeSegmentNames(path string, names []string) error {
-	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0600)
-	if err != nil {
+// The names are written to a temporary file which then replaces the trunk,
+// so the trunk is never left partially written when db crashes.
+func writeSegmentNames(path string, names []string, perm os.FileMode) error {
+	var b []byte
+	for _, segName := range names {
+		b = append(b, segName+"\n"...)
+	}
+	b = append([]byte(checksumLine(b)), b...)
+
+	tmp := path + ".tmp"
+	if err := writeFileSync(tmp, b, perm); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
 		return err
 	}
-	defer f.Close()
+	// The rename is durable only when the dir is flushed to disk.
+	return syncDir(filepath.Dir(path))
+}
 
-	buf := bufio.NewWriter(f)
-	for _, segName := range names {
-		if _, err = buf.WriteString(segName + "\n"); err != nil {
-			return err
-		}
+// checksumLine returns the trunk's first line which contains CRC-32 checksum of segment names b.
+func checksumLine(b []byte) string {
+	return fmt.Sprintf("%s%08x\n", trunkChecksumPrefix, crc32.ChecksumIEEE(b))
+}
+
+// writeFileSync writes b to a file and flushes it to disk.
+// If the file doesn't exist, it is created with permissions perm.
+func writeFileSync(path string, b []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, perm)
+	if err != nil {
+		return err
 	}
 
-	if err = buf.Flush(); err != nil {
+	if _, err = f.Write(b); err != nil {
+		f.Close()
 		return err
 	}
 	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// syncDir flushes the dir entries to disk, e.g., after a file was renamed.
+func syncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	if err = d.Sync(); err != nil {
+		d.Close()
 		return err
 	}
-	return nil
+	return d.Close()
 }
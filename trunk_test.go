@@ -1,6 +1,12 @@
 package rascaldb
 
-import "testing"
+import (
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"testing"
+)
 
 func TestReadSegmentNames(t *testing.T) {
 	segments, err := readSegmentNames("testdata/readtrunk.txt")
@@ -16,7 +22,7 @@ func TestReadSegmentNames(t *testing.T) {
 
 func TestWriteSegmentNames(t *testing.T) {
 	segments := []string{"fizz", "bazz"}
-	err := writeSegmentNames("testdata/writetrunk.txt", segments)
+	err := writeSegmentNames("testdata/writetrunk.txt", segments, 0600)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -31,3 +37,79 @@ func TestWriteSegmentNames(t *testing.T) {
 
 	teardown()
 }
+
+func TestWriteSegmentNames_shorter(t *testing.T) {
+	if err := writeSegmentNames("testdata/writetrunk.txt", []string{"fizz", "bazz"}, 0600); err != nil {
+		t.Fatal(err)
+	}
+	segments := []string{"fizzbazz"}
+	if err := writeSegmentNames("testdata/writetrunk.txt", segments, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := readSegmentNames("testdata/writetrunk.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equal(got, segments) {
+		t.Errorf("writeSegmentNames() wrote %q, want %q", got, segments)
+	}
+
+	teardown()
+}
+
+func TestWriteSegmentNames_checksum(t *testing.T) {
+	if err := writeSegmentNames("testdata/writetrunk.txt", []string{"fizz", "bazz"}, 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer teardown()
+
+	b, err := ioutil.ReadFile("testdata/writetrunk.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "crc32 " + fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte("fizz\nbazz\n"))) + "\nfizz\nbazz\n"
+	if string(b) != want {
+		t.Errorf("writeSegmentNames() wrote %q, want %q", b, want)
+	}
+	if _, err = os.Stat("testdata/writetrunk.txt.tmp"); !os.IsNotExist(err) {
+		t.Errorf("writeSegmentNames() temporary file was not renamed")
+	}
+}
+
+func TestReadSegmentNames_corrupted(t *testing.T) {
+	if err := writeSegmentNames("testdata/writetrunk.txt", []string{"fizz", "bazz"}, 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer teardown()
+	b, err := ioutil.ReadFile("testdata/writetrunk.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checksum := string(b[:len(b)-len("fizz\nbazz\n")])
+
+	tt := []struct {
+		name    string
+		content string
+	}{
+		{"empty", ""},
+		{"partial line", string(b[:len(b)-1])},
+		{"partial checksum", checksum[:len(checksum)-1]},
+		{"checksum only", checksum},
+		{"cut short at line boundary", checksum + "fizz\n"},
+		{"checksum mismatch", checksum + "fizz\nbuzz\n"},
+		{"empty name", "fizz\n\nbazz\n"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := ioutil.WriteFile("testdata/writetrunk.txt", []byte(tc.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := readSegmentNames("testdata/writetrunk.txt"); err != ErrTrunkCorrupted {
+				t.Errorf("readSegmentNames(%q) got %v, want %v", tc.content, err, ErrTrunkCorrupted)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package rascaldb
+
+import "context"
+
+// Tx is a transaction created by DB.Update or DB.View.
+// It buffers writes until commit, so they are not visible to other readers beforehand.
+// Transactions are optimistic: the keys read by a transaction are checked at commit time,
+// and if any of them was modified by others (or moved by compaction), the transaction fails with ErrConflict.
+// Tx is valid only within the function passed to Update or View and it is not concurrency safe.
+type Tx struct {
+	db *DB
+	// ctx is the context of the transaction which is checked by reads and the commit.
+	ctx      context.Context
+	writable bool
+	// reads keeps locations of the keys' records at the time they were read first.
+	reads map[string]location
+	// writes keeps the latest buffered write of each key, so the transaction can read its own writes.
+	writes map[string]batchOp
+	// batch is a sequence of writes to be applied on commit.
+	batch Batch
+}
+
+// Update runs fn in a read-write transaction.
+// If fn returns nil, the transaction is committed, otherwise its writes are discarded.
+// ErrConflict is returned when the keys read by the transaction were modified concurrently,
+// in that case fn can be retried.
+func (db *DB) Update(fn func(tx *Tx) error) error {
+	return db.UpdateContext(context.Background(), fn)
+}
+
+// UpdateContext is like Update, but the transaction's reads and commit return ctx.Err() when the context is done.
+// Note, the transaction could have been committed anyway if the context was canceled during the commit.
+func (db *DB) UpdateContext(ctx context.Context, fn func(tx *Tx) error) error {
+	tx := Tx{
+		db:       db,
+		ctx:      ctx,
+		writable: true,
+		reads:    make(map[string]location),
+		writes:   make(map[string]batchOp),
+	}
+	if err := fn(&tx); err != nil {
+		return err
+	}
+	return tx.commit()
+}
+
+// View runs fn in a read-only transaction. Writes within the transaction return ErrTxReadOnly.
+func (db *DB) View(fn func(tx *Tx) error) error {
+	return db.ViewContext(context.Background(), fn)
+}
+
+// ViewContext is like View, but the transaction's reads return ctx.Err() when the context is done.
+func (db *DB) ViewContext(ctx context.Context, fn func(tx *Tx) error) error {
+	tx := Tx{
+		db:    db,
+		ctx:   ctx,
+		reads: make(map[string]location),
+	}
+	return fn(&tx)
+}
+
+// Get retrieves a key like DB.Get. The key is read from the transaction's writes first.
+func (tx *Tx) Get(key string) ([]byte, error) {
+	if op, ok := tx.writes[key]; ok {
+		if op.deleted {
+			return nil, ErrKeyNotFound
+		}
+		return op.value, nil
+	}
+
+	value, loc, err := tx.db.get(tx.ctx, key)
+	if err != nil && err != ErrKeyNotFound {
+		return nil, err
+	}
+	if _, ok := tx.reads[key]; !ok {
+		tx.reads[key] = loc
+	}
+	return value, err
+}
+
+// Set puts a key in the transaction. It is written to database on commit.
+func (tx *Tx) Set(key string, value []byte) error {
+	if !tx.writable {
+		return ErrTxReadOnly
+	}
+	tx.batch.Set(key, value)
+	tx.writes[key] = tx.batch.ops[len(tx.batch.ops)-1]
+	return nil
+}
+
+// Delete removes a key in the transaction. It is deleted from database on commit.
+func (tx *Tx) Delete(key string) error {
+	if !tx.writable {
+		return ErrTxReadOnly
+	}
+	tx.batch.Delete(key)
+	tx.writes[key] = tx.batch.ops[len(tx.batch.ops)-1]
+	return nil
+}
+
+// commit checks whether the keys read by the transaction were modified and writes the batch in the actor.
+// Since the actor is the only writer, nothing can be modified between the check and the write.
+func (tx *Tx) commit() error {
+	if tx.batch.Len() == 0 {
+		return nil
+	}
+	batch, err := tx.batch.encode()
+	if err != nil {
+		return err
+	}
+	return tx.db.do(tx.ctx, func() error {
+		ss := tx.db.segments.Load().([]*segment)
+		for key, loc := range tx.reads {
+			if locate(ss, key) != loc {
+				return ErrConflict
+			}
+		}
+
+		current, err := tx.db.current()
+		if err != nil {
+			return err
+		}
+		err = current.writeBatches([]encodedBatch{batch})
+		tx.db.invalidate(batch)
+		return err
+	})
+}
@@ -0,0 +1,167 @@
+package rascaldb
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestDB_Update(t *testing.T) {
+	dbpath := "testdata/tx.db"
+	db, err := Open(dbpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Set("counter", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.Update(func(tx *Tx) error {
+		v, err := tx.Get("counter")
+		if err != nil {
+			return err
+		}
+		if err = tx.Set("counter", append(v, '1')); err != nil {
+			return err
+		}
+		if err = tx.Set("name", []byte("Bob")); err != nil {
+			return err
+		}
+		// Buffered writes are not visible outside of the transaction.
+		if _, err = db.Get("name"); err != ErrKeyNotFound {
+			t.Errorf("Get(%q) error %v, want %v", "name", err, ErrKeyNotFound)
+		}
+		// The transaction reads its own writes.
+		if v, err = tx.Get("counter"); err != nil || !bytes.Equal(v, []byte("11")) {
+			t.Errorf("Tx.Get(%q) = %q, %v, want %q", "counter", v, err, "11")
+		}
+		if err = tx.Delete("name"); err != nil {
+			return err
+		}
+		if _, err = tx.Get("name"); err != ErrKeyNotFound {
+			t.Errorf("Tx.Get(%q) error %v, want %v", "name", err, ErrKeyNotFound)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Update() error %v", err)
+	}
+
+	if got, err := db.Get("counter"); err != nil || !bytes.Equal(got, []byte("11")) {
+		t.Errorf("Get(%q) = %q, %v, want %q", "counter", got, err, "11")
+	}
+	if _, err = db.Get("name"); err != ErrKeyNotFound {
+		t.Errorf("Get(%q) error %v, want %v", "name", err, ErrKeyNotFound)
+	}
+
+	teardown()
+}
+
+func TestDB_Update_conflict(t *testing.T) {
+	dbpath := "testdata/tx.db"
+	db, err := Open(dbpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Set("counter", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	tt := []struct {
+		name   string
+		key    string
+		modify func() error
+	}{
+		{"overwritten", "counter", func() error { return db.Set("counter", []byte("2")) }},
+		{"deleted", "counter", func() error { return db.Delete("counter") }},
+		{"created", "new", func() error { return db.Set("new", []byte("1")) }},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			err := db.Update(func(tx *Tx) error {
+				tx.Get(tc.key)
+				// Another writer modifies the key which was read by the transaction.
+				if err := tc.modify(); err != nil {
+					t.Fatal(err)
+				}
+				return tx.Set("result", []byte("1"))
+			})
+			if err != ErrConflict {
+				t.Errorf("Update() error %v, want %v", err, ErrConflict)
+			}
+			if _, err = db.Get("result"); err != ErrKeyNotFound {
+				t.Errorf("Get(%q) error %v, want %v", "result", err, ErrKeyNotFound)
+			}
+		})
+	}
+
+	// Keys which were not read don't cause conflicts.
+	err = db.Update(func(tx *Tx) error {
+		if err := db.Set("other", []byte("1")); err != nil {
+			t.Fatal(err)
+		}
+		return tx.Set("result", []byte("1"))
+	})
+	if err != nil {
+		t.Errorf("Update() error %v", err)
+	}
+
+	teardown()
+}
+
+func TestDB_Update_rollback(t *testing.T) {
+	dbpath := "testdata/tx.db"
+	db, err := Open(dbpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	errRollback := errors.New("rollback")
+	err = db.Update(func(tx *Tx) error {
+		if err := tx.Set("name", []byte("Bob")); err != nil {
+			return err
+		}
+		return errRollback
+	})
+	if err != errRollback {
+		t.Errorf("Update() error %v, want %v", err, errRollback)
+	}
+	if _, err = db.Get("name"); err != ErrKeyNotFound {
+		t.Errorf("Get(%q) error %v, want %v", "name", err, ErrKeyNotFound)
+	}
+
+	teardown()
+}
+
+func TestDB_View(t *testing.T) {
+	dbpath := "testdata/tx.db"
+	db, err := Open(dbpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = db.Set("name", []byte("Bob")); err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.View(func(tx *Tx) error {
+		if v, err := tx.Get("name"); err != nil || !bytes.Equal(v, []byte("Bob")) {
+			t.Errorf("Tx.Get(%q) = %q, %v, want %q", "name", v, err, "Bob")
+		}
+		if err := tx.Set("name", []byte("Rob")); err != ErrTxReadOnly {
+			t.Errorf("Tx.Set() error %v, want %v", err, ErrTxReadOnly)
+		}
+		if err := tx.Delete("name"); err != ErrTxReadOnly {
+			t.Errorf("Tx.Delete() error %v, want %v", err, ErrTxReadOnly)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("View() error %v", err)
+	}
+
+	teardown()
+}